@@ -0,0 +1,456 @@
+package ipecho
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultACMETTL    = 10
+	defaultACMEExpire = time.Hour
+	// acmeTokens is the number of tokens kept per account, a certificate for a domain and its wildcard needs two
+	acmeTokens = 2
+	// acmeTokenLength is the length of a DNS-01 token, the base64url encoded SHA-256 of the key authorization
+	acmeTokenLength = 43
+	acmeLabel       = "_acme-challenge."
+)
+
+// acmeAccount may set the DNS-01 tokens of a single name.
+type acmeAccount struct {
+	Username string `json:"username"`
+	// Key is the hex encoded SHA-256 of the password
+	Key       string `json:"key"`
+	Subdomain string `json:"subdomain"`
+	// Name is the lower cased, fully qualified name the tokens are served at
+	Name      string   `json:"name"`
+	AllowFrom []string `json:"allowfrom,omitempty"`
+	allow     []*net.IPNet
+	// Tokens are kept with the account, so they survive a reload or restart while the CA validates them
+	Tokens []acmeToken `json:"tokens,omitempty"`
+}
+
+type acmeToken struct {
+	Txt     string    `json:"txt"`
+	Expires time.Time `json:"expires"`
+}
+
+// acmeResponder serves DNS-01 tokens set with an acme-dns compatible HTTP API.
+//
+//	POST /register   registers an account, the body may carry "allowfrom" networks and the "domain" to serve
+//	POST /update     sets a token, the body carries the "subdomain" and the "txt" of the account
+//	GET  /health     reports that the API is up
+//
+// Updates must carry the credentials of the account as X-Api-User and X-Api-Key. The tokens are served as TXT
+// at _acme-challenge.<domain>, accounts without a domain get _acme-challenge.<subdomain>.<zone> to be used as
+// the target of a CNAME. The domain has to be below one of the domains of the acme block or, without them,
+// belong to a domain of the plugin.
+type acmeResponder struct {
+	addr string
+	// zone holds the names of the accounts without a domain, the first domain if it is not given
+	zone string
+	// domains limits the domains accounts can be registered for, the domains of the plugin if empty
+	domains []string
+	// config returns the current config, the domains of the plugin change with the file and the admin API
+	config func() *config
+	ttl    uint32
+	// expire is the time a token is served for
+	expire time.Duration
+	// register lists the networks of the clients that may register accounts
+	register []*net.IPNet
+	// path is the file the accounts and their tokens are kept in, empty keeps them in memory
+	path string
+
+	mu       sync.RWMutex
+	accounts map[string]*acmeAccount
+	// names holds the accounts by the name their tokens are served at
+	names map[string]*acmeAccount
+	now   func() time.Time
+}
+
+// parseACMEPart parses "acme <address> [{ zone, domains, accounts, register, ttl, expire }]".
+func parseACMEPart(c *caddyfile.Dispenser, cfg *config) error {
+	if cfg.ACME != nil {
+		return c.Err("acme is given twice")
+	}
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	a := &acmeResponder{
+		addr:     c.Val(),
+		ttl:      defaultACMETTL,
+		expire:   defaultACMEExpire,
+		register: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, {IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)}},
+		accounts: map[string]*acmeAccount{},
+		names:    map[string]*acmeAccount{},
+		now:      time.Now,
+	}
+	if c.NextArg() {
+		if c.Val() != "{" {
+			return c.ArgErr()
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			if err := a.parseOption(c.Val(), c.RemainingArgs()); err != nil {
+				return c.Err(err.Error())
+			}
+		}
+	}
+	if err := a.load(); err != nil {
+		return c.Err(err.Error())
+	}
+	cfg.ACME = a
+	return nil
+}
+
+func (a *acmeResponder) parseOption(name string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("acme %s needs a value", name)
+	}
+	var err error
+	switch strings.ToLower(name) {
+	case "zone":
+		a.zone, err = normalizeDomain(args[0])
+	case "domains":
+		a.domains = make([]string, len(args))
+		for i, arg := range args {
+			if a.domains[i], err = normalizeDomain(arg); err != nil {
+				return err
+			}
+		}
+	case "accounts":
+		a.path = args[0]
+	case "register":
+		a.register, err = parseNetworks(args)
+	case "ttl":
+		a.ttl, err = parseTTL(args[0])
+	case "expire":
+		a.expire, err = time.ParseDuration(args[0])
+		if err == nil && a.expire <= 0 {
+			err = fmt.Errorf("invalid token expiry: '%s'", args[0])
+		}
+	default:
+		return fmt.Errorf("unknown property '%s' for acme", name)
+	}
+	return err
+}
+
+// load reads the accounts, a missing file has no accounts.
+func (a *acmeResponder) load() error {
+	if a.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read acme accounts: %w", err)
+	}
+	var accounts []*acmeAccount
+	if err := json.Unmarshal(b, &accounts); err != nil {
+		return fmt.Errorf("unable to read acme accounts %s: %w", a.path, err)
+	}
+	for _, account := range accounts {
+		if len(account.AllowFrom) > 0 {
+			if account.allow, err = parseNetworks(account.AllowFrom); err != nil {
+				return fmt.Errorf("%s: %w", a.path, err)
+			}
+		}
+		a.accounts[account.Username] = account
+		a.names[account.Name] = account
+	}
+	return nil
+}
+
+// save writes the accounts, it replaces the previous file atomically.
+func (a *acmeResponder) save() error {
+	if a.path == "" {
+		return nil
+	}
+	accounts := make([]*acmeAccount, 0, len(a.accounts))
+	for _, account := range a.accounts {
+		accounts = append(accounts, account)
+	}
+	b, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// records returns the TXT records of the tokens served at qname that did not expire.
+// It is safe to call on a nil a.
+func (a *acmeResponder) records(qname string) []dns.RR {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	account := a.names[strings.ToLower(qname)]
+	if account == nil {
+		return nil
+	}
+	now := a.now()
+	var rrs []dns.RR
+	for _, token := range account.Tokens {
+		if now.Before(token.Expires) {
+			rrs = append(rrs, &dns.TXT{
+				Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: a.ttl},
+				Txt: []string{token.Txt},
+			})
+		}
+	}
+	return rrs
+}
+
+// below reports whether tokens that did not expire are served at names below qname, which makes qname an empty
+// non-terminal. It is safe to call on a nil a.
+func (a *acmeResponder) below(qname string) bool {
+	if a == nil {
+		return false
+	}
+	qname = strings.ToLower(qname)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	now := a.now()
+	for name, account := range a.names {
+		if name == qname || !dns.IsSubDomain(qname, name) {
+			continue
+		}
+		for _, token := range account.Tokens {
+			if now.Before(token.Expires) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type acmeRegistration struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Fulldomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type acmeUpdate struct {
+	Subdomain string `json:"subdomain"`
+	Txt       string `json:"txt"`
+}
+
+func (a *acmeResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/health" && r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Path == "/register" && r.Method == http.MethodPost:
+		a.serveRegister(w, r)
+	case r.URL.Path == "/update" && r.Method == http.MethodPost:
+		a.serveUpdate(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, adminError{Error: "not found"})
+	}
+}
+
+func (a *acmeResponder) serveRegister(w http.ResponseWriter, r *http.Request) {
+	if !containsIP(a.register, remoteIP(r)) {
+		writeJSON(w, http.StatusUnauthorized, adminError{Error: "forbidden"})
+		return
+	}
+	var body struct {
+		AllowFrom []string `json:"allowfrom"`
+		Domain    string   `json:"domain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "malformed_json_payload"})
+		return
+	}
+	account := &acmeAccount{Username: randomUUID(), Subdomain: randomUUID(), AllowFrom: body.AllowFrom}
+	if len(body.AllowFrom) > 0 {
+		var err error
+		if account.allow, err = parseNetworks(body.AllowFrom); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: "invalid_allowfrom_cidr"})
+			return
+		}
+	}
+	account.Name = acmeLabel + account.Subdomain + "." + a.zone
+	if body.Domain != "" {
+		domain, err := normalizeDomain(strings.TrimPrefix(body.Domain, "*."))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: "bad_domain"})
+			return
+		}
+		if !a.allowed(domain) {
+			writeJSON(w, http.StatusForbidden, adminError{Error: "forbidden_domain"})
+			return
+		}
+		account.Name = acmeLabel + domain
+	}
+	password := randomPassword()
+	key := sha256.Sum256([]byte(password))
+	account.Key = hex.EncodeToString(key[:])
+
+	a.mu.Lock()
+	if a.names[account.Name] != nil {
+		a.mu.Unlock()
+		writeJSON(w, http.StatusConflict, adminError{Error: "domain_already_registered"})
+		return
+	}
+	a.accounts[account.Username] = account
+	a.names[account.Name] = account
+	err := a.save()
+	if err != nil {
+		delete(a.accounts, account.Username)
+		delete(a.names, account.Name)
+	}
+	a.mu.Unlock()
+	if err != nil {
+		log.Printf("[ipecho] Warning: unable to save acme accounts: %s\n", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{Error: "db_error"})
+		return
+	}
+
+	log.Printf("[ipecho] ACME API: registered account for '%s'\n", account.Name)
+	allowFrom := account.AllowFrom
+	if allowFrom == nil {
+		allowFrom = []string{}
+	}
+	writeJSON(w, http.StatusCreated, acmeRegistration{
+		Username:   account.Username,
+		Password:   password,
+		Fulldomain: strings.TrimSuffix(account.Name, "."),
+		Subdomain:  account.Subdomain,
+		AllowFrom:  allowFrom,
+	})
+}
+
+// allowed reports whether an account can be registered for domain.
+func (a *acmeResponder) allowed(domain string) bool {
+	if len(a.domains) == 0 {
+		d, _, _ := a.config().match(domain)
+		return d != nil
+	}
+	for _, d := range a.domains {
+		if dns.IsSubDomain(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acmeResponder) serveUpdate(w http.ResponseWriter, r *http.Request) {
+	var update acmeUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "malformed_json_payload"})
+		return
+	}
+	key := sha256.Sum256([]byte(r.Header.Get("X-Api-Key")))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	account := a.accounts[r.Header.Get("X-Api-User")]
+	if account == nil || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(key[:])), []byte(account.Key)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, adminError{Error: "forbidden"})
+		return
+	}
+	if len(account.allow) > 0 && !containsIP(account.allow, remoteIP(r)) {
+		writeJSON(w, http.StatusUnauthorized, adminError{Error: "forbidden"})
+		return
+	}
+	if update.Subdomain != account.Subdomain {
+		writeJSON(w, http.StatusUnauthorized, adminError{Error: "forbidden"})
+		return
+	}
+	if !validToken(update.Txt) {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "bad_txt"})
+		return
+	}
+
+	now := a.now()
+	tokens := []acmeToken{{Txt: update.Txt, Expires: now.Add(a.expire)}}
+	for _, token := range account.Tokens {
+		if len(tokens) < acmeTokens && now.Before(token.Expires) {
+			tokens = append(tokens, token)
+		}
+	}
+	previous := account.Tokens
+	account.Tokens = tokens
+	if err := a.save(); err != nil {
+		account.Tokens = previous
+		log.Printf("[ipecho] Warning: unable to save acme accounts: %s\n", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{Error: "db_error"})
+		return
+	}
+	log.Printf("[ipecho] ACME API: updated token of '%s'\n", account.Name)
+	writeJSON(w, http.StatusOK, struct {
+		Txt string `json:"txt"`
+	}{update.Txt})
+}
+
+// validToken reports whether txt can be a DNS-01 token.
+func validToken(txt string) bool {
+	if len(txt) != acmeTokenLength {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(txt)
+	return err == nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the client of r.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func randomPassword() string {
+	b := make([]byte, 30)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,161 @@
+package ipecho
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+func TestACME(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme.json")
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example.com
+			domain acme.example.org
+			acme 127.0.0.1:0 {
+				zone acme.example.org
+				accounts `+path+`
+				ttl 5
+				expire 10m
+			}
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	now := time.Now()
+	cfg.ACME.now = func() time.Time { return now }
+	p := ipecho{Config: cfg}
+
+	do := func(path, client string, header map[string]string, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.RemoteAddr = net.JoinHostPort(client, "4711")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		cfg.ACME.ServeHTTP(rec, req)
+		var resp map[string]interface{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	txt := func(name string) []string {
+		w := &dummyResponseWriter{}
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeTXT)
+		p.ServeDNS(context.Background(), w, r)
+		var txt []string
+		for _, rr := range w.GetMsgs()[0].Answer {
+			require.Equal(t, uint32(5), rr.Header().Ttl)
+			txt = append(txt, rr.(*dns.TXT).Txt...)
+		}
+		return txt
+	}
+	token := func(c string) string { return strings.Repeat(c, acmeTokenLength) }
+
+	code, account := do("/register", "127.0.0.1", nil, `{"domain": "*.example.com"}`)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, "_acme-challenge.example.com", account["fulldomain"])
+	credentials := map[string]string{"X-Api-User": account["username"].(string), "X-Api-Key": account["password"].(string)}
+	update := func(header map[string]string, subdomain, txt string) int {
+		code, _ := do("/update", "127.0.0.1", header, `{"subdomain": "`+subdomain+`", "txt": "`+txt+`"}`)
+		return code
+	}
+
+	t.Run("Register", func(t *testing.T) {
+		code, _ := do("/register", "192.0.2.1", nil, "")
+		require.Equal(t, http.StatusUnauthorized, code, "only local clients may register")
+
+		code, _ = do("/register", "::1", nil, `{"domain": "example.com"}`)
+		require.Equal(t, http.StatusConflict, code)
+
+		code, delegated := do("/register", "::1", nil, "")
+		require.Equal(t, http.StatusCreated, code)
+		require.Equal(t, "_acme-challenge."+delegated["subdomain"].(string)+".acme.example.org", delegated["fulldomain"])
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		subdomain := account["subdomain"].(string)
+		require.Equal(t, http.StatusOK, update(credentials, subdomain, token("a")))
+		require.Equal(t, []string{token("a")}, txt("_acme-challenge.example.com."))
+
+		require.Equal(t, http.StatusOK, update(credentials, subdomain, token("b")))
+		require.Equal(t, http.StatusOK, update(credentials, subdomain, token("c")))
+		require.Equal(t, []string{token("c"), token("b")}, txt("_acme-challenge.example.com."), "the last two tokens are kept")
+		require.Equal(t, []string{token("c"), token("b")}, txt("_ACME-Challenge.Example.com."))
+
+		reloaded := &acmeResponder{path: path, ttl: 5, accounts: map[string]*acmeAccount{}, names: map[string]*acmeAccount{}, now: cfg.ACME.now}
+		require.NoError(t, reloaded.load())
+		require.Equal(t, 2, len(reloaded.records("_acme-challenge.example.com.")), "tokens survive a reload")
+
+		now = now.Add(11 * time.Minute)
+		w := &dummyResponseWriter{}
+		r := new(dns.Msg)
+		r.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, dns.RcodeNameError, w.GetMsgs()[0].Rcode, "tokens expire")
+	})
+
+	t.Run("Empty Non-Terminal", func(t *testing.T) {
+		code, delegated := do("/register", "127.0.0.1", nil, "")
+		require.Equal(t, http.StatusCreated, code)
+		subdomain := delegated["subdomain"].(string)
+		require.Equal(t, http.StatusOK, update(map[string]string{
+			"X-Api-User": delegated["username"].(string), "X-Api-Key": delegated["password"].(string),
+		}, subdomain, token("e")))
+		require.Equal(t, []string{token("e")}, txt("_acme-challenge."+subdomain+".acme.example.org."))
+
+		w := &dummyResponseWriter{}
+		r := new(dns.Msg)
+		r.SetQuestion(subdomain+".acme.example.org.", dns.TypeTXT)
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, dns.RcodeSuccess, w.GetMsgs()[0].Rcode)
+		require.Empty(t, w.GetMsgs()[0].Answer)
+	})
+
+	t.Run("Forbidden", func(t *testing.T) {
+		subdomain := account["subdomain"].(string)
+		require.Equal(t, http.StatusUnauthorized, update(nil, subdomain, token("d")))
+		require.Equal(t, http.StatusUnauthorized, update(map[string]string{
+			"X-Api-User": credentials["X-Api-User"], "X-Api-Key": "wrong",
+		}, subdomain, token("d")))
+		require.Equal(t, http.StatusUnauthorized, update(credentials, "other", token("d")))
+		require.Equal(t, http.StatusBadRequest, update(credentials, subdomain, "short"))
+	})
+
+	t.Run("Accounts", func(t *testing.T) {
+		a := &acmeResponder{path: path, accounts: map[string]*acmeAccount{}, names: map[string]*acmeAccount{}}
+		require.NoError(t, a.load())
+		require.Equal(t, 3, len(a.accounts))
+		require.Equal(t, "_acme-challenge.example.com.", a.accounts[credentials["X-Api-User"]].Name)
+		require.NotContains(t, a.accounts[credentials["X-Api-User"]].Key, credentials["X-Api-Key"])
+	})
+
+	t.Run("Domains", func(t *testing.T) {
+		code, _ := do("/register", "::1", nil, `{"domain": "example.net"}`)
+		require.Equal(t, http.StatusForbidden, code, "example.net is not a domain of the plugin")
+		code, _ = do("/register", "::1", nil, `{"domain": "www.acme.example.org"}`)
+		require.Equal(t, http.StatusCreated, code)
+
+		require.Error(t, cfg.ACME.parseOption("domains", []string{"127.0.0.1"}))
+		require.NoError(t, cfg.ACME.parseOption("domains", []string{"WWW.example.com"}))
+		require.Equal(t, []string{"www.example.com."}, cfg.ACME.domains)
+		defer func() { cfg.ACME.domains = nil }()
+		code, _ = do("/register", "::1", nil, `{"domain": "example.com.example.net"}`)
+		require.Equal(t, http.StatusForbidden, code)
+		code, _ = do("/register", "::1", nil, `{"domain": "acme.example.org"}`)
+		require.Equal(t, http.StatusForbidden, code, "only below the domains of the acme block")
+		code, _ = do("/register", "::1", nil, `{"domain": "*.api.www.example.com"}`)
+		require.Equal(t, http.StatusCreated, code)
+	})
+}
@@ -0,0 +1,150 @@
+package ipecho
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errDomainNotFound = errors.New("domain not found")
+	errLastDomain     = errors.New("the last domain cannot be removed")
+	errInvalidDomain  = errors.New("invalid domain")
+)
+
+// adminAPI is a local HTTP API to list, add and remove domains at runtime.
+//
+//	GET    /domains            lists the domains with their options
+//	PUT    /domains/<domain>   adds or replaces a domain, the body may carry its options as JSON
+//	DELETE /domains/<domain>   removes a domain
+//
+// Every request must carry the configured token as "Authorization: Bearer <token>".
+type adminAPI struct {
+	token string
+	store *configStore
+}
+
+func newAdminAPI(token string, store *configStore) *adminAPI {
+	return &adminAPI{token: token, store: store}
+}
+
+type adminDomains struct {
+	Domains []domainSpec `json:"domains"`
+}
+
+func newAdminDomains(cfg *config) adminDomains {
+	domains := adminDomains{Domains: make([]domainSpec, 0, len(cfg.Domains))}
+	for _, d := range cfg.Domains {
+		domains.Domains = append(domains.Domains, d.spec())
+	}
+	return domains
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, adminError{Error: "unauthorized"})
+		return
+	}
+
+	if r.URL.Path == "/domains" {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, newAdminDomains(a.store.Load()))
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/domains/")
+	if name == r.URL.Path || name == "" {
+		writeJSON(w, http.StatusNotFound, adminError{Error: "not found"})
+		return
+	}
+	domain, err := normalizeDomain(name)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPut:
+		var d *domainConfig
+		d, err = a.readDomain(r, domain)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		err = a.store.Update(func(cfg *config) error {
+			if cfg.replaceDomain(d) {
+				status = http.StatusCreated
+			}
+			if err := cfg.checkUpdates(); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidDomain, err)
+			}
+			if err := cfg.checkTransferKeys(); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidDomain, err)
+			}
+			return nil
+		})
+	case http.MethodDelete:
+		err = a.store.Update(func(cfg *config) error {
+			if len(cfg.Domains) == 1 && cfg.Domains[0].Name == domain {
+				return errLastDomain
+			}
+			if !cfg.removeDomain(domain) {
+				return errDomainNotFound
+			}
+			return nil
+		})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	switch {
+	case errors.Is(err, errDomainNotFound):
+		writeJSON(w, http.StatusNotFound, adminError{Error: err.Error()})
+	case errors.Is(err, errInvalidDomain):
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+	case errors.Is(err, errLastDomain):
+		writeJSON(w, http.StatusConflict, adminError{Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, adminError{Error: err.Error()})
+	default:
+		log.Printf("[ipecho] Admin API: %s %s\n", r.Method, domain)
+		writeJSON(w, status, newAdminDomains(a.store.Load()))
+	}
+}
+
+// readDomain reads the options of domain from the request body, an empty body adds the domain without options.
+func (*adminAPI) readDomain(r *http.Request, domain string) (*domainConfig, error) {
+	spec := domainSpec{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid body: %w", err)
+	}
+	if spec.Name != "" && !strings.EqualFold(dns.Fqdn(spec.Name), domain) {
+		return nil, fmt.Errorf("name '%s' does not match the domain in the path", spec.Name)
+	}
+	spec.Name = domain
+	return spec.domainConfig()
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
@@ -0,0 +1,123 @@
+package ipecho
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	store := newConfigStore(&config{
+		Domains:       []*domainConfig{{Name: "example1.com."}},
+		domainOptions: domainOptions{TTL: 60},
+	})
+	api := newAdminAPI("secret", store)
+	p := ipecho{Store: store}
+
+	do := func(method, path, token, body string) (int, adminDomains) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		var domains adminDomains
+		_ = json.Unmarshal(rec.Body.Bytes(), &domains)
+		return rec.Code, domains
+	}
+	names := func(domains adminDomains) []string {
+		var names []string
+		for _, d := range domains.Domains {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	answers := func(name string) int {
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+		if len(d.GetMsgs()) == 0 {
+			return 0
+		}
+		return len(d.GetMsgs()[0].Answer)
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		code, _ := do(http.MethodGet, "/domains", "", "")
+		require.Equal(t, http.StatusUnauthorized, code)
+		code, _ = do(http.MethodPut, "/domains/example2.com", "wrong", "")
+		require.Equal(t, http.StatusUnauthorized, code)
+		require.Equal(t, []string{"example1.com."}, store.Load().domainNames())
+	})
+
+	t.Run("List", func(t *testing.T) {
+		code, domains := do(http.MethodGet, "/domains", "secret", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{"example1.com."}, names(domains))
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		require.Equal(t, 0, answers("127.0.0.1.example2.com."))
+		old := store.Load()
+
+		code, domains := do(http.MethodPut, "/domains/Example2.com.", "secret", "")
+		require.Equal(t, http.StatusCreated, code)
+		require.Equal(t, []string{"example1.com.", "example2.com."}, names(domains))
+		require.Equal(t, 1, answers("127.0.0.1.example2.com."))
+		// the previous config is left untouched for in-flight queries
+		require.Equal(t, []string{"example1.com."}, old.domainNames())
+
+		code, _ = do(http.MethodPut, "/domains/127.0.0.1", "secret", "")
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Replace With Options", func(t *testing.T) {
+		code, domains := do(http.MethodPut, "/domains/example2.com", "secret", `{"ttl": 30, "families": ["v6"]}`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{"example1.com.", "example2.com."}, names(domains))
+		require.Equal(t, uint32(30), *domains.Domains[1].TTL)
+		require.Equal(t, []string{"v6"}, domains.Domains[1].Families)
+		require.Equal(t, 0, answers("127.0.0.1.example2.com."))
+		require.Equal(t, 1, answers("::1.example2.com."))
+
+		code, _ = do(http.MethodPut, "/domains/example2.com", "secret", `{"families": ["v5"]}`)
+		require.Equal(t, http.StatusBadRequest, code)
+		code, _ = do(http.MethodPut, "/domains/example2.com", "secret", `{"name": "example3.com"}`)
+		require.Equal(t, http.StatusBadRequest, code)
+		code, _ = do(http.MethodPut, "/domains/example2.com", "secret", `{"tll": 30}`)
+		require.Equal(t, http.StatusBadRequest, code)
+		code, _ = do(http.MethodPut, "/domains/example2.com", "secret", `{"transfer": ["192.0.2.0/24", "key", "xfr."]}`)
+		require.Equal(t, http.StatusBadRequest, code, "unknown transfer key")
+		code, _ = do(http.MethodPut, "/domains/example2.com", "secret", `{"update": ["ci."]}`)
+		require.Equal(t, http.StatusBadRequest, code, "unknown update key and no dynamic file")
+		require.Empty(t, store.Load().findDomain("example2.com.").Update)
+		require.Empty(t, store.Load().findDomain("example2.com.").Transfer)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		code, domains := do(http.MethodDelete, "/domains/example1.com", "secret", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{"example2.com."}, names(domains))
+		require.Equal(t, 0, answers("127.0.0.1.example1.com."))
+
+		code, _ = do(http.MethodDelete, "/domains/example1.com", "secret", "")
+		require.Equal(t, http.StatusNotFound, code)
+		code, _ = do(http.MethodDelete, "/domains/example2.com", "secret", "")
+		require.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("Invalid Method", func(t *testing.T) {
+		code, _ := do(http.MethodPost, "/domains", "secret", "")
+		require.Equal(t, http.StatusMethodNotAllowed, code)
+		code, _ = do(http.MethodPost, "/domains/example3.com", "secret", "")
+		require.Equal(t, http.StatusMethodNotAllowed, code)
+	})
+}
@@ -0,0 +1,171 @@
+package ipecho
+
+import (
+	"log"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// aliasMode is how names under an alias are answered.
+type aliasMode uint8
+
+const (
+	// aliasDecode answers names under the alias like the same names under the domain
+	aliasDecode aliasMode = iota
+	// aliasCNAME answers names under the alias with a CNAME to the same name under the domain
+	aliasCNAME
+	// aliasDNAME answers names under the alias with a DNAME of the alias and the CNAME it synthesizes
+	aliasDNAME
+)
+
+// maxRedirects limits the CNAMEs chased for a single question, aliases of domains inside other aliases can form
+// loops.
+const maxRedirects = 8
+
+// redirectsKey holds the number of CNAMEs chased for the question in the context.
+type redirectsKey struct{}
+
+// aliasConfig is a domain that shares the definition of another domain.
+type aliasConfig struct {
+	// Name of the alias, lower cased and fully qualified
+	Name string
+	// Target is the name of the domain the alias shares the definition of
+	Target string
+	Mode   aliasMode
+}
+
+func (a *aliasConfig) String() string {
+	s := a.Name + " -> " + a.Target
+	switch a.Mode {
+	case aliasCNAME:
+		s += " (cname)"
+	case aliasDNAME:
+		s += " (dname)"
+	case aliasDecode:
+	}
+	return s
+}
+
+// parseAliasPart parses an alias line, "alias <name> [->] <domain> [cname|dname]".
+func parseAliasPart(c *caddyfile.Dispenser, cfg *config) error {
+	var args []string
+	for _, arg := range c.RemainingArgs() {
+		if arg != "->" {
+			args = append(args, arg)
+		}
+	}
+	//nolint: gomnd // alias, domain and optional mode
+	if len(args) < 2 || len(args) > 3 {
+		return c.ArgErr()
+	}
+	name, err := normalizeDomain(args[0])
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	target, err := normalizeDomain(args[1])
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	if name == target {
+		return c.Errf("alias '%s' points to itself", name)
+	}
+	if dns.IsSubDomain(name, target) {
+		return c.Errf("alias '%s' points to '%s' below itself", name, target)
+	}
+	a := &aliasConfig{Name: name, Target: target}
+	//nolint: gomnd // optional mode
+	if len(args) == 3 {
+		switch strings.ToLower(args[2]) {
+		case "cname":
+			a.Mode = aliasCNAME
+		case "dname":
+			a.Mode = aliasDNAME
+		default:
+			return c.Errf("unknown alias mode '%s'", args[2])
+		}
+	}
+	for _, other := range cfg.Aliases {
+		if other.Name == name {
+			return c.Errf("alias '%s' is given twice", name)
+		}
+	}
+	cfg.Aliases = append(cfg.Aliases, a)
+	return nil
+}
+
+// warnUnknownAliases logs aliases that point to a domain that is not configured.
+func (cfg *config) warnUnknownAliases() {
+	for _, a := range cfg.Aliases {
+		if cfg.findDomain(a.Target) == nil {
+			log.Printf("[ipecho] Warning: alias '%s' points to '%s' which is not a domain\n", a.Name, a.Target)
+		}
+	}
+}
+
+// match returns the domain qname belongs to, the alias qname uses for it (nil if none) and the part of qname in
+// front of the domain or alias. Aliases are matched first, so an alias can be inside a domain.
+func (cfg *config) match(qname string) (*domainConfig, *aliasConfig, string) {
+	lower := strings.ToLower(qname)
+	for _, a := range cfg.Aliases {
+		if !dns.IsSubDomain(a.Name, lower) {
+			continue
+		}
+		if domain := cfg.findDomain(a.Target); domain != nil {
+			return domain, a, qname[:len(qname)-len(a.Name)]
+		}
+	}
+	for _, domain := range cfg.Domains {
+		if dns.IsSubDomain(domain.Name, lower) {
+			return domain, nil, qname[:len(qname)-len(domain.Name)]
+		}
+	}
+	return nil, nil, ""
+}
+
+// aliasNames returns the aliases for the logs.
+func (cfg *config) aliasNames() string {
+	names := make([]string, 0, len(cfg.Aliases))
+	for _, a := range cfg.Aliases {
+		names = append(names, a.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// redirect answers a name under the alias of res with a CNAME, or the DNAME of the alias and the CNAME it
+// synthesizes, to the same name under the domain. The answer for that name is added as well.
+func (p *ipecho) redirect(ctx context.Context, w dns.ResponseWriter, question *dns.Question, v *view,
+	res resolution, alias *aliasConfig, subdomain string,
+) resolution {
+	target := subdomain + res.domain.Name
+	if p.Config.Debug {
+		log.Printf("[ipecho] Redirecting '%s' to '%s'\n", question.Name, target)
+	}
+	res.exists = true
+	if alias.Mode == aliasDNAME {
+		res.answer = append(res.answer, dname(alias, res.opts.TTL))
+	}
+	res.answer = append(res.answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: res.opts.TTL},
+		Target: target,
+	})
+	redirects, _ := ctx.Value(redirectsKey{}).(int)
+	if question.Qtype == dns.TypeCNAME || redirects >= maxRedirects {
+		return res
+	}
+	ctx = context.WithValue(ctx, redirectsKey{}, redirects+1)
+	chased := p.resolve(ctx, w, &dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}, v)
+	res.answer = append(res.answer, chased.answer...)
+	res.extra, res.ip = chased.extra, chased.ip
+	return res
+}
+
+// dname returns the DNAME record of alias.
+func dname(alias *aliasConfig, ttl uint32) dns.RR {
+	return &dns.DNAME{
+		Hdr:    dns.RR_Header{Name: alias.Name, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: alias.Target,
+	}
+}
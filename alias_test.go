@@ -0,0 +1,128 @@
+package ipecho
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+func TestServeDNSAliases(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example1.com {
+				ttl 60
+				formats dash
+				record www A 192.0.2.1
+			}
+			alias ipecho.io -> example1.com
+			alias example2.com example1.com cname
+			alias example3.com example1.com DNAME
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(cfg.Aliases))
+	p := ipecho{Config: cfg}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		w := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), w, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: qtype}},
+		})
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0]
+	}
+
+	t.Run("Decode", func(t *testing.T) {
+		m := query("10-0-0-1.ipecho.io.", dns.TypeA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "10-0-0-1.ipecho.io.", m.Answer[0].Header().Name)
+		require.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+		require.Equal(t, net.ParseIP("10.0.0.1").To4(), m.Answer[0].(*dns.A).A.To4())
+
+		m = query("WWW.ipecho.io.", dns.TypeA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "WWW.ipecho.io.", m.Answer[0].Header().Name)
+		require.Equal(t, net.ParseIP("192.0.2.1").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("Negative Answer Uses Alias SOA", func(t *testing.T) {
+		m := query("10.0.0.1.ipecho.io.", dns.TypeA)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+		require.Equal(t, "ipecho.io.", m.Ns[0].Header().Name)
+
+		m = query("ipecho.io.", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Empty(t, m.Answer)
+	})
+
+	t.Run("CNAME", func(t *testing.T) {
+		m := query("10-0-0-1.example2.com.", dns.TypeA)
+		require.Equal(t, 2, len(m.Answer))
+		require.Equal(t, "10-0-0-1.example1.com.", m.Answer[0].(*dns.CNAME).Target)
+		require.Equal(t, "10-0-0-1.example1.com.", m.Answer[1].Header().Name)
+		require.Equal(t, net.ParseIP("10.0.0.1").To4(), m.Answer[1].(*dns.A).A.To4())
+
+		m = query("10-0-0-1.example2.com.", dns.TypeCNAME)
+		require.Equal(t, 1, len(m.Answer))
+
+		m = query("example2.com.", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Empty(t, m.Answer)
+	})
+
+	t.Run("DNAME", func(t *testing.T) {
+		m := query("app.10-0-0-1.example3.com.", dns.TypeA)
+		require.Equal(t, 3, len(m.Answer))
+		require.Equal(t, "example3.com.", m.Answer[0].Header().Name)
+		require.Equal(t, "example1.com.", m.Answer[0].(*dns.DNAME).Target)
+		require.Equal(t, "app.10-0-0-1.example1.com.", m.Answer[1].(*dns.CNAME).Target)
+		require.Equal(t, net.ParseIP("10.0.0.1").To4(), m.Answer[2].(*dns.A).A.To4())
+
+		m = query("example3.com.", dns.TypeDNAME)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "example1.com.", m.Answer[0].(*dns.DNAME).Target)
+	})
+
+	t.Run("Invalid Aliases", func(t *testing.T) {
+		for _, line := range []string{
+			"alias ipecho.io",
+			"alias ipecho.io example1.com cname extra",
+			"alias ipecho.io example1.com alias",
+			"alias example1.com example1.com",
+			"alias 127.0.0.1 example1.com",
+			"alias ipecho.io example1.com\nalias ipecho.io example1.com cname",
+			"alias example.com sub.example.com cname",
+		} {
+			dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte("{\ndomain example1.com\n"+line+"\n}")))
+			cfg, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, line)
+			require.Nil(t, cfg)
+		}
+	})
+
+	t.Run("Redirect Loop", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain x.example4.com
+				domain y.example5.com
+				alias example5.com x.example4.com cname
+				alias example4.com y.example5.com cname
+			}
+		`)))
+		cfg, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		p := ipecho{Config: cfg}
+		w := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), w, &dns.Msg{
+			Question: []dns.Question{{Name: "www.example5.com.", Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+		require.Equal(t, 1, len(w.GetMsgs()))
+		require.Equal(t, maxRedirects+1, len(w.GetMsgs()[0].Answer))
+	})
+}
@@ -0,0 +1,117 @@
+package ipecho
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// anyMode is how ANY queries are answered (RFC 8482).
+type anyMode uint8
+
+const (
+	// anyMinimal answers a single RRset, the A or AAAA records of the name or a HINFO record if there are none
+	anyMinimal anyMode = iota
+	// anyHINFO answers a HINFO record with the CPU "RFC8482"
+	anyHINFO
+	// anyFull answers the A and AAAA records of the name, only over TCP
+	anyFull
+)
+
+func parseAnyMode(s string) (anyMode, error) {
+	switch strings.ToLower(s) {
+	case "minimal":
+		return anyMinimal, nil
+	case "hinfo":
+		return anyHINFO, nil
+	case "full":
+		return anyFull, nil
+	}
+	return 0, fmt.Errorf("unknown any mode: '%s'", s)
+}
+
+// parseAnyPart parses "any <udp mode> [<tcp mode>]", full can only be used over TCP.
+// Without a TCP mode TCP is answered like UDP.
+func parseAnyPart(args []string, cfg *config) error {
+	//nolint: gomnd // udp and tcp mode
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("any takes a mode for UDP and optionally one for TCP")
+	}
+	udp, err := parseAnyMode(args[0])
+	if err != nil {
+		return err
+	}
+	if udp == anyFull {
+		return fmt.Errorf("any full can only be used over TCP")
+	}
+	tcp := udp
+	if len(args) == 2 {
+		if tcp, err = parseAnyMode(args[1]); err != nil {
+			return err
+		}
+	}
+	cfg.AnyUDP, cfg.AnyTCP = udp, tcp
+	return nil
+}
+
+// resolveAny answers an ANY query with the mode of the transport of w instead of every record of the name, so
+// ANY cannot be used for amplification.
+func (p *ipecho) resolveAny(ctx context.Context, w dns.ResponseWriter, question *dns.Question, v *view) resolution {
+	mode := p.Config.AnyUDP
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); tcp {
+		mode = p.Config.AnyTCP
+	}
+
+	// the sub-lookups do not count, the answer is counted once below
+	quiet := *p
+	quiet.Stats = nil
+	q := *question
+	q.Qtype = dns.TypeA
+	res := quiet.resolve(ctx, w, &q, v)
+	if res.domain == nil {
+		return res
+	}
+	if mode == anyFull {
+		q.Qtype = dns.TypeAAAA
+		more := quiet.resolve(ctx, w, &q, v)
+		res.exists = res.exists || more.exists
+		for _, rr := range more.answer {
+			if !containsRR(res.answer, rr) {
+				res.answer = append(res.answer, rr)
+			}
+		}
+		if res.ip == nil {
+			res.ip = more.ip
+		}
+	} else if len(res.answer) == 0 && mode == anyMinimal {
+		q.Qtype = dns.TypeAAAA
+		more := quiet.resolve(ctx, w, &q, v)
+		res.exists, res.answer, res.ip = res.exists || more.exists, more.answer, more.ip
+	}
+	if !res.exists {
+		return res
+	}
+	if mode == anyHINFO || len(res.answer) == 0 {
+		res.answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: res.opts.TTL},
+			Cpu: "RFC8482",
+		}}
+		// the HINFO record does not echo the address
+		res.ip = nil
+	}
+	res.extra = nil
+	p.record(w, res)
+	return res
+}
+
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package ipecho
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAny(t *testing.T) {
+	newPlugin := func(lines string) ipecho {
+		return newTestPlugin(t, `
+			{
+				domain example.com {
+					record www A 192.0.2.1
+					record www AAAA 2001:db8::1
+					record txt TXT "only text"
+				}
+				ttl 60
+				`+lines+`
+			}
+		`)
+	}
+	queryAny := func(p ipecho, name string, tcp bool) *dns.Msg {
+		w := &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		if tcp {
+			w.remoteAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+		}
+		return queryFrom(t, p, w, name, dns.TypeANY)
+	}
+
+	t.Run("Minimal", func(t *testing.T) {
+		p := newPlugin("")
+		require.Equal(t, []string{"10.0.0.1.example.com.\t60\tIN\tA\t10.0.0.1"}, rrStrings(queryAny(p, "10.0.0.1.example.com.", false).Answer))
+		require.Equal(t, []string{"www.example.com.\t60\tIN\tA\t192.0.2.1"}, rrStrings(queryAny(p, "www.example.com.", true).Answer),
+			"a single RRset")
+		require.Equal(t, []string{"txt.example.com.\t60\tIN\tHINFO\t\"RFC8482\" \"\""}, rrStrings(queryAny(p, "txt.example.com.", false).Answer))
+		require.Equal(t, dns.RcodeNameError, queryAny(p, "invalid.example.com.", false).Rcode)
+	})
+
+	t.Run("HINFO", func(t *testing.T) {
+		p := newPlugin("any hinfo full")
+		require.Equal(t, []string{"10.0.0.1.example.com.\t60\tIN\tHINFO\t\"RFC8482\" \"\""}, rrStrings(queryAny(p, "10.0.0.1.example.com.", false).Answer))
+		require.Equal(t, []string{"10.0.0.1.example.com.\t60\tIN\tA\t10.0.0.1"}, rrStrings(queryAny(p, "10.0.0.1.example.com.", true).Answer))
+		require.Equal(t, []string{
+			"www.example.com.\t60\tIN\tA\t192.0.2.1",
+			"www.example.com.\t60\tIN\tAAAA\t2001:db8::1",
+		}, rrStrings(queryAny(p, "www.example.com.", true).Answer), "the full A/AAAA set over TCP")
+		require.Equal(t, []string{"txt.example.com.\t60\tIN\tHINFO\t\"RFC8482\" \"\""}, rrStrings(queryAny(p, "txt.example.com.", true).Answer))
+	})
+
+	t.Run("Statistics", func(t *testing.T) {
+		total := func(lines string, name string, tcp bool) uint64 {
+			p := newPlugin(lines)
+			p.Stats = newStatistics([]time.Duration{time.Minute})
+			queryAny(p, name, tcp)
+			return p.Stats.report().Totals["example.com."]
+		}
+		require.Equal(t, uint64(1), total("", "10.0.0.1.example.com.", false))
+		require.Equal(t, uint64(1), total("", "2001:db8::1.example.com.", false))
+		require.Equal(t, uint64(1), total("any minimal full", "10.0.0.1.example.com.", true), "counted once")
+		require.Equal(t, uint64(0), total("any hinfo", "10.0.0.1.example.com.", false), "HINFO does not echo the address")
+		require.Equal(t, uint64(0), total("", "www.example.com.", false))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		require.Error(t, parseAnyPart([]string{"full"}, &config{}))
+		require.Error(t, parseAnyPart([]string{"minimal", "all"}, &config{}))
+		require.Error(t, parseAnyPart(nil, &config{}))
+	})
+}
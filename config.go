@@ -5,92 +5,567 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
 type config struct {
 	// Domains defines the Domains we will react to
-	Domains []string
-	// TTL to use for response
-	TTL uint32
+	Domains []*domainConfig
+	// domainOptions are inherited by every domain that does not set them itself
+	domainOptions
+	// Aliases are domains that share the definition of another domain
+	Aliases []*aliasConfig
+	// Views override the domains for the clients in their networks, the first matching view is used
+	Views []*view
 	// Debug mode
 	Debug bool
+	// Fall holds the zones that are passed to the next plugin instead of being answered negatively
+	Fall fall.F
+	// Serial of the synthesized SOA records
+	Serial uint32
+	// Nameservers are the names of the synthesized NS records, the first one is the name server of the synthesized
+	// SOA. Names without a trailing dot are relative to the zone, ns1 is used if there are none
+	Nameservers []string
+	// Hostmaster is the mailbox of the synthesized SOA, relative to the zone without a trailing dot
+	Hostmaster string
+	// TSIG are the secrets of the TSIG keys by key name, transfers need to be signed with one if there are any
+	TSIG map[string]string
+	// Dynamic is the path of the file the records of dynamic updates are kept in, empty disables updates
+	Dynamic string
+	// ACME serves DNS-01 tokens set with its HTTP API, nil if it is disabled
+	ACME *acmeResponder
+	// AnyUDP and AnyTCP are how ANY queries are answered over UDP and TCP
+	AnyUDP anyMode
+	AnyTCP anyMode
+	// Dnstap is the socket endpoint dnstap frames are sent to, empty disables dnstap
+	Dnstap string
+	// Stats is the listen address of the statistics endpoint, empty disables statistics
+	Stats string
+	// StatsWindows are the sliding windows the statistics are kept for
+	StatsWindows []time.Duration
+	// Admin is the listen address of the admin API, empty disables the admin API
+	Admin string
+	// AdminToken is the bearer token the admin API requires
+	AdminToken string
+	// File is the path of a YAML file with additional domains, empty disables the file
+	File string
+	// FileReload is the interval the file is checked for changes
+	FileReload time.Duration
 }
 
 const (
 	defaultTTL = 2629800
+	// maxTTL is the largest TTL allowed by RFC 2181
+	maxTTL = 1<<31 - 1
 )
 
-func newConfigFromDispenser(c caddyfile.Dispenser) (*config, error) {
+// newConfigFromDispenser parses the ipecho directive c points to. Domains can be given as arguments of the
+// directive or with domain lines, without any the zones (the server block keys) are used.
+func newConfigFromDispenser(c caddyfile.Dispenser, zones ...string) (*config, error) {
 	cfg := config{
-		TTL: defaultTTL,
+		domainOptions: domainOptions{TTL: defaultTTL},
+		Serial:        uint32(time.Now().Unix()),
+	}
+
+	// arguments are only possible if the dispenser points to the directive itself
+	if c.Val() != "" {
+		for _, arg := range c.RemainingArgs() {
+			domain, err := normalizeDomain(arg)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			cfg.addDomainOnce(&domainConfig{Name: domain})
+		}
 	}
 
 	for c.NextBlock() {
 		var err error
 		if strings.EqualFold(c.Val(), "domain") {
-			err = parseDomainPart(c, &cfg)
-		} else if strings.EqualFold(c.Val(), "ttl") {
-			err = parseTTLPart(c, &cfg)
+			err = parseDomainPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "alias") {
+			err = parseAliasPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "view") {
+			err = parseViewPart(&c, &cfg)
+		} else if _, ok := optionParsers[strings.ToLower(c.Val())]; ok {
+			_, err = parseOptionPart(&c, &cfg.domainOptions)
 		} else if strings.EqualFold(c.Val(), "debug") {
-			err = parseDebugPart(c, &cfg)
+			err = parseDebugPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "dnstap") {
+			err = parseDnstapPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "stats") {
+			err = parseStatsPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "admin") {
+			err = parseAdminPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "file") {
+			err = parseFilePart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "tsig") {
+			if err = parseTSIGPart(c.RemainingArgs(), &cfg); err != nil {
+				err = c.Err(err.Error())
+			}
+		} else if strings.EqualFold(c.Val(), "dynamic") {
+			if err = parseDynamicPart(c.RemainingArgs(), &cfg); err != nil {
+				err = c.Err(err.Error())
+			}
+		} else if strings.EqualFold(c.Val(), "acme") {
+			err = parseACMEPart(&c, &cfg)
+		} else if strings.EqualFold(c.Val(), "any") {
+			if err = parseAnyPart(c.RemainingArgs(), &cfg); err != nil {
+				err = c.Err(err.Error())
+			}
+		} else if strings.EqualFold(c.Val(), "nameservers") {
+			if err = parseNameserversPart(c.RemainingArgs(), &cfg); err != nil {
+				err = c.Err(err.Error())
+			}
+		} else if strings.EqualFold(c.Val(), "hostmaster") {
+			if err = parseHostmasterPart(c.RemainingArgs(), &cfg); err != nil {
+				err = c.Err(err.Error())
+			}
+		} else if strings.EqualFold(c.Val(), "fallthrough") {
+			cfg.Fall.SetZonesFromArgs(c.RemainingArgs())
+		} else {
+			err = c.Errf("unknown property '%s'", c.Val())
 		}
 		if err != nil {
 			return nil, err
 		}
 	}
+	if len(cfg.Domains) == 0 && cfg.File == "" {
+		for _, zone := range zones {
+			for _, host := range plugin.Host(zone).NormalizeExact() {
+				cfg.addDomain(&domainConfig{Name: host})
+			}
+		}
+	}
+	cfg.warnOverlappingDomains()
+	if cfg.File == "" {
+		cfg.warnUnknownAliases()
+	}
 	if cfg.Debug {
 		log.Println("[ipecho] Debug Mode is on")
-		log.Printf("[ipecho] Parsed %d Domains: %s\n", len(cfg.Domains), strings.Join(cfg.Domains, ", "))
+		log.Printf("[ipecho] Parsed %d Domains: %s\n", len(cfg.Domains), strings.Join(cfg.domainNames(), ", "))
 		log.Printf("[ipecho] TTL is %d", cfg.TTL)
+		if len(cfg.Aliases) > 0 {
+			log.Printf("[ipecho] Parsed %d Aliases: %s\n", len(cfg.Aliases), cfg.aliasNames())
+		}
+		if len(cfg.Views) > 0 {
+			log.Printf("[ipecho] Parsed %d Views: %s\n", len(cfg.Views), cfg.viewNames())
+		}
+		if cfg.Dnstap != "" {
+			log.Printf("[ipecho] Sending dnstap frames to %s", cfg.Dnstap)
+		}
+		if cfg.Stats != "" {
+			log.Printf("[ipecho] Serving statistics on %s", cfg.Stats)
+		}
+		if cfg.Admin != "" {
+			log.Printf("[ipecho] Serving admin API on %s", cfg.Admin)
+		}
+		if cfg.File != "" {
+			log.Printf("[ipecho] Loading domains from %s every %s", cfg.File, cfg.FileReload)
+		}
+		if cfg.Dynamic != "" {
+			log.Printf("[ipecho] Keeping updated records in %s", cfg.Dynamic)
+		}
+		if cfg.ACME != nil {
+			log.Printf("[ipecho] Serving acme API on %s", cfg.ACME.addr)
+		}
 	}
-	if len(cfg.Domains) == 0 {
+	if len(cfg.Domains) == 0 && cfg.File == "" {
 		return nil, fmt.Errorf("there is no domain to handle")
 	}
+	if err := cfg.checkUpdates(); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkTransferKeys(); err != nil {
+		return nil, err
+	}
+	if cfg.ACME != nil && cfg.ACME.zone == "" {
+		if len(cfg.Domains) == 0 {
+			return nil, fmt.Errorf("acme needs a zone if there is no domain in the Corefile")
+		}
+		cfg.ACME.zone = cfg.Domains[0].Name
+	}
+	if cfg.ACME != nil {
+		cfg.ACME.config = func() *config { return &cfg }
+	}
 	return &cfg, nil
 }
 
-func parseDomainPart(c caddyfile.Dispenser, cfg *config) error {
+func parseDomainPart(c *caddyfile.Dispenser, cfg *config) error {
+	d, err := parseDomainBlock(c)
+	if err != nil {
+		return err
+	}
+	cfg.addDomainOnce(d)
+	return nil
+}
+
+// parseDomainBlock parses the name of a domain and its optional block.
+func parseDomainBlock(c *caddyfile.Dispenser) (*domainConfig, error) {
 	if !c.NextArg() {
-		return nil
+		return nil, c.ArgErr()
 	}
-	domain := strings.ToLower(strings.Trim(c.Val(), "."))
-	if !govalidator.IsDNSName(domain) {
-		return fmt.Errorf("'%s' is not a valid domain name", domain)
+	name, err := normalizeDomain(c.Val())
+	if err != nil {
+		return nil, c.Err(err.Error())
 	}
-	domain += "."
+	d := &domainConfig{Name: name}
 
-	exists := false
-	for i := range cfg.Domains {
-		if cfg.Domains[i] == domain {
-			exists = true
-			break
+	if c.NextArg() {
+		if c.Val() != "{" {
+			return nil, c.ArgErr()
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			if err := parseDomainOptionPart(c, d); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if !exists {
-		cfg.Domains = append(cfg.Domains, domain)
+	if err := d.loadRecords(); err != nil {
+		return nil, c.Err(err.Error())
+	}
+	if err := d.loadKeys(); err != nil {
+		return nil, c.Err(err.Error())
+	}
+	return d, nil
+}
+
+// parseDomainOptionPart parses a line of a domain block.
+func parseDomainOptionPart(c *caddyfile.Dispenser, d *domainConfig) error {
+	switch {
+	case strings.EqualFold(c.Val(), "record"):
+		args := c.RemainingArgs()
+		//nolint: gomnd // at least name, type and data
+		if len(args) < 3 {
+			return c.ArgErr()
+		}
+		line := recordLine(args)
+		if _, err := parseRecord(d.Name, line); err != nil {
+			return c.Err(err.Error())
+		}
+		d.RecordLines = append(d.RecordLines, line)
+	case strings.EqualFold(c.Val(), "hosts"):
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		d.Hosts = args[0]
+	case strings.EqualFold(c.Val(), "dnssec"):
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if strings.EqualFold(args[0], "auto") {
+			if d.Rollover != nil || len(d.KeyFiles) > 0 {
+				return c.Errf("dnssec keys are given twice for domain '%s'", d.Name)
+			}
+			m, err := newKeyManager(d.Name, args[1:])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			d.Rollover = m
+			return nil
+		}
+		if d.Rollover != nil {
+			return c.Errf("dnssec keys are given twice for domain '%s'", d.Name)
+		}
+		d.KeyFiles = append(d.KeyFiles, args...)
+	case strings.EqualFold(c.Val(), "template"):
+		args := c.RemainingArgs()
+		//nolint: gomnd // type and template
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		t, err := parseAnswerTemplate(d.Name, args[0], recordLine(args[1:]))
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if d.Templates == nil {
+			d.Templates = answerTemplates{}
+		}
+		if _, ok := d.Templates[t.Type]; ok {
+			return c.Errf("template for %s given twice for domain '%s'", dns.TypeToString[t.Type], d.Name)
+		}
+		d.Templates[t.Type] = t
+	default:
+		if _, ok := optionParsers[strings.ToLower(c.Val())]; !ok {
+			return c.Errf("unknown property '%s' for domain '%s'", c.Val(), d.Name)
+		}
+		set, err := parseOptionPart(c, &d.domainOptions)
+		if err != nil {
+			return err
+		}
+		d.set |= set
 	}
 	return nil
 }
 
-func parseTTLPart(c caddyfile.Dispenser, cfg *config) error {
-	if !c.NextArg() {
-		return nil
+//nolint: gochecknoglobals // lookup table for the options that can be set per domain
+var optionParsers = map[string]func(args []string, opts *domainOptions) (option, error){
+	"ttl":        parseTTLOption,
+	"formats":    parseFormatsOption,
+	"families":   parseFamiliesOption,
+	"allow":      parseAllowOption,
+	"deny":       parseDenyOption,
+	"nat":        parseNATOption,
+	"default":    parseDefaultOption,
+	"transfer":   parseTransferOption,
+	"enumerate":  parseEnumerateOption,
+	"update":     parseUpdateOption,
+	"safeguards": parseSafeguardsOption,
+	"alpn":       parseALPNOption,
+	"port":       parsePortOption,
+	"mx":         parseMXOption,
+}
+
+// parseOptionPart parses a domain option at the plugin level or in a domain block and returns which option was set.
+func parseOptionPart(c *caddyfile.Dispenser, opts *domainOptions) (option, error) {
+	parse := optionParsers[strings.ToLower(c.Val())]
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return 0, c.ArgErr()
+	}
+	set, err := parse(args, opts)
+	if err != nil {
+		return 0, c.Err(err.Error())
 	}
+	return set, nil
+}
+
+func parseTTLOption(args []string, opts *domainOptions) (option, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("ttl takes exactly one value")
+	}
+	ttl, err := parseTTL(args[0])
+	if err != nil {
+		return 0, err
+	}
+	opts.TTL = ttl
+	return optionTTL, nil
+}
+
+// parseTTL parses a TTL, RFC 2181 limits TTLs to 2^31-1.
+func parseTTL(s string) (uint32, error) {
 	//nolint: gomnd // parse ttl as uint32 with base 10
-	ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+	ttl, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
-		return fmt.Errorf("invalid TTL value: '%s'", c.Val())
+		return 0, fmt.Errorf("invalid TTL value: '%s'", s)
+	}
+	if ttl > maxTTL {
+		return 0, fmt.Errorf("TTL value '%s' is larger than %d", s, maxTTL)
+	}
+	return uint32(ttl), nil
+}
+
+func parseFormatsOption(args []string, opts *domainOptions) (option, error) {
+	var err error
+	opts.Formats, err = parseFormats(args)
+	return optionFormats, err
+}
+
+func parseFamiliesOption(args []string, opts *domainOptions) (option, error) {
+	var err error
+	opts.Families, err = parseFamilies(args)
+	return optionFamilies, err
+}
+
+func parseAllowOption(args []string, opts *domainOptions) (option, error) {
+	var err error
+	opts.Allow, err = parseNetworks(args)
+	return optionAllow, err
+}
+
+func parseDenyOption(args []string, opts *domainOptions) (option, error) {
+	var err error
+	opts.Deny, err = parseNetworks(args)
+	return optionDeny, err
+}
+
+// parseNATOption adds a mapping, every nat line adds one.
+func parseNATOption(args []string, opts *domainOptions) (option, error) {
+	//nolint: gomnd // from and to
+	if len(args) != 2 {
+		return 0, fmt.Errorf("nat takes a network to translate from and one to translate to")
+	}
+	m, err := parseNATMapping(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	opts.NAT = append(opts.NAT, m)
+	return optionNAT, nil
+}
+
+func parseDefaultOption(args []string, opts *domainOptions) (option, error) {
+	var err error
+	opts.Default, err = parseAddresses(args)
+	return optionDefault, err
+}
+
+
+func parseAdminPart(c *caddyfile.Dispenser, cfg *config) error {
+	args := c.RemainingArgs()
+	//nolint: gomnd // listen address and token
+	if len(args) != 2 {
+		return c.ArgErr()
+	}
+	cfg.Admin, cfg.AdminToken = args[0], args[1]
+	return nil
+}
+
+func parseFilePart(c *caddyfile.Dispenser, cfg *config) error {
+	args := c.RemainingArgs()
+	//nolint: gomnd // path and optional reload interval
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	cfg.File = args[0]
+	cfg.FileReload = defaultFileReload
+	if len(args) == 2 {
+		reload, err := time.ParseDuration(args[1])
+		if err != nil || reload <= 0 {
+			return c.Errf("invalid file reload interval: '%s'", args[1])
+		}
+		cfg.FileReload = reload
 	}
-	cfg.TTL = uint32(ttl)
 	return nil
 }
 
-//nolint: unparam // result is always nil
-func parseDebugPart(_ caddyfile.Dispenser, cfg *config) error {
+// normalizeDomain validates name and returns it lower cased and fully qualified.
+// Internationalized names are converted to their ASCII (punycode) form.
+func normalizeDomain(name string) (string, error) {
+	domain := strings.ToLower(strings.Trim(name, "."))
+	if domain == "" && name != "" {
+		// the root zone
+		return ".", nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("'%s' is not a valid domain name: %w", domain, err)
+	}
+	if !govalidator.IsDNSName(ascii) {
+		return "", fmt.Errorf("'%s' is not a valid domain name", domain)
+	}
+	return ascii + ".", nil
+}
+
+// addDomainOnce adds a domain parsed from the Corefile and warns about a domain that is given twice.
+func (cfg *config) addDomainOnce(d *domainConfig) {
+	if !cfg.addDomain(d) {
+		log.Printf("[ipecho] Warning: domain '%s' is given more than once, only the first one is used\n", d.Name)
+	}
+}
+
+// warnOverlappingDomains warns about domains that are subdomains of other domains, the first match wins.
+func (cfg *config) warnOverlappingDomains() {
+	for i, a := range cfg.Domains {
+		for j, b := range cfg.Domains {
+			if i != j && dns.IsSubDomain(b.Name, a.Name) {
+				log.Printf("[ipecho] Warning: domain '%s' overlaps with '%s'\n", a.Name, b.Name)
+			}
+		}
+	}
+}
+
+// addDomain adds a domain, it reports false if a domain with the same name was already present.
+func (cfg *config) addDomain(d *domainConfig) bool {
+	if cfg.findDomain(d.Name) != nil {
+		return false
+	}
+	cfg.Domains = append(cfg.Domains, d)
+	return true
+}
+
+// replaceDomain adds a domain or replaces the domain with the same name, it reports false if it was replaced.
+func (cfg *config) replaceDomain(d *domainConfig) bool {
+	for i := range cfg.Domains {
+		if cfg.Domains[i].Name == d.Name {
+			cfg.Domains[i] = d
+			return false
+		}
+	}
+	cfg.Domains = append(cfg.Domains, d)
+	return true
+}
+
+// removeDomain removes a normalized domain, it reports false if the domain was not present.
+func (cfg *config) removeDomain(name string) bool {
+	for i := range cfg.Domains {
+		if cfg.Domains[i].Name == name {
+			cfg.Domains = append(cfg.Domains[:i:i], cfg.Domains[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *config) findDomain(name string) *domainConfig {
+	for _, d := range cfg.Domains {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func (cfg *config) domainNames() []string {
+	names := make([]string, 0, len(cfg.Domains))
+	for _, d := range cfg.Domains {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+// clone returns a copy of cfg that can be modified without affecting cfg.
+// Domains are shared, they are replaced instead of being modified once published.
+func (cfg *config) clone() *config {
+	c := *cfg
+	c.Domains = append([]*domainConfig(nil), cfg.Domains...)
+	c.StatsWindows = append([]time.Duration(nil), cfg.StatsWindows...)
+	return &c
+}
+
+func parseDebugPart(c *caddyfile.Dispenser, cfg *config) error {
+	if c.NextArg() {
+		return c.ArgErr()
+	}
 	cfg.Debug = true
 	return nil
 }
+
+func parseDnstapPart(c *caddyfile.Dispenser, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if _, err := parseTapEndpoint(args[0]); err != nil {
+		return c.Err(err.Error())
+	}
+	cfg.Dnstap = args[0]
+	return nil
+}
+
+func parseStatsPart(c *caddyfile.Dispenser, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	cfg.Stats = args[0]
+	for _, arg := range args[1:] {
+		window, err := time.ParseDuration(arg)
+		if err != nil || window <= 0 {
+			return c.Errf("invalid statistics window: '%s'", arg)
+		}
+		cfg.StatsWindows = append(cfg.StatsWindows, window)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package ipecho
 
 import (
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy/caddyfile"
 	"github.com/stretchr/testify/require"
@@ -23,8 +24,8 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		require.NoError(t, err)
 		require.NotNil(t, config)
 		require.Equal(t, 2, len(config.Domains))
-		require.Equal(t, "example1.com.", config.Domains[0])
-		require.Equal(t, "example2.com.", config.Domains[1])
+		require.Equal(t, "example1.com.", config.Domains[0].Name)
+		require.Equal(t, "example2.com.", config.Domains[1].Name)
 		require.Equal(t, uint32(60), config.TTL)
 		require.Equal(t, true, config.Debug)
 	})
@@ -77,4 +78,182 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		require.Error(t, err)
 		require.Nil(t, config)
 	})
+	t.Run("Stats", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				Domain example1.com
+				Stats localhost:9154 1m 1h
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "localhost:9154", config.Stats)
+		require.Equal(t, []time.Duration{time.Minute, time.Hour}, config.StatsWindows)
+
+		dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				Domain example1.com
+				Stats localhost:9154 forever
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Domain Blocks", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain example1.com {
+					ttl 60
+					formats dash dotted
+					families v4
+					deny 10.0.0.0/8 192.168.1.1
+				}
+				domain example2.com
+				ttl 120
+				allow 127.0.0.0/8
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"example1.com.", "example2.com."}, config.domainNames())
+
+		opts := config.effectiveOptions(config.Domains[0])
+		require.Equal(t, uint32(60), opts.TTL)
+		require.Equal(t, formatDash|formatDotted, opts.Formats)
+		require.Equal(t, familyV4, opts.Families)
+		require.Equal(t, []string{"10.0.0.0/8", "192.168.1.1/32"}, networkStrings(opts.Deny))
+		require.Equal(t, []string{"127.0.0.0/8"}, networkStrings(opts.Allow))
+
+		opts = config.effectiveOptions(config.Domains[1])
+		require.Equal(t, uint32(120), opts.TTL)
+		require.Equal(t, formatDotted, opts.Formats)
+		require.Equal(t, familyV4|familyV6, opts.Families)
+		require.Empty(t, opts.Deny)
+	})
+	t.Run("Invalid Domain Blocks", func(t *testing.T) {
+		for _, block := range []string{
+			"domain example1.com {\n tll 60\n }",
+			"domain example1.com {\n formats hex\n }",
+			"domain example1.com {\n families v5\n }",
+			"domain example1.com {\n deny 10.0.0.0/33\n }",
+			"domain example1.com example2.com",
+		} {
+			dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte("{\n"+block+"\n}")))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, block)
+			require.Nil(t, config)
+		}
+	})
+	t.Run("Inline Arguments", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`ipecho example1.com Example2.com. {
+				domain example3.com
+			}
+		`)))
+		dispenser.Next()
+		config, err := newConfigFromDispenser(dispenser, "example4.com.")
+		require.NoError(t, err)
+		require.Equal(t, []string{"example1.com.", "example2.com.", "example3.com."}, config.domainNames())
+
+		dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte(`ipecho 127.0.0.1`)))
+		dispenser.Next()
+		config, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Server Block Zones", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`ipecho`)))
+		dispenser.Next()
+		config, err := newConfigFromDispenser(dispenser, "example1.com.:53", "dns://Example2.com.")
+		require.NoError(t, err)
+		require.Equal(t, []string{"example1.com.", "example2.com."}, config.domainNames())
+
+		dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte(`ipecho {
+				ttl 60
+			}
+		`)))
+		dispenser.Next()
+		config, err = newConfigFromDispenser(dispenser, ".")
+		require.NoError(t, err)
+		require.Equal(t, []string{"."}, config.domainNames())
+		require.Equal(t, uint32(60), config.TTL)
+	})
+	t.Run("Strict Validation", func(t *testing.T) {
+		for block, expected := range map[string]string{
+			"tll 60":                             "Corefile:3 - Error during parsing: unknown property 'tll'",
+			"domain":                             "Corefile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'domain'",
+			"ttl":                                "Corefile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'ttl'",
+			"ttl 60 120":                         "Corefile:3 - Error during parsing: ttl takes exactly one value",
+			"ttl 2147483648":                     "Corefile:3 - Error during parsing: TTL value '2147483648' is larger than 2147483647",
+			"debug yes":                          "Corefile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'yes'",
+			"dnstap":                             "Corefile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'dnstap'",
+			"admin localhost:9155":               "Corefile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'localhost:9155'",
+			"file a.yaml 30s 40s":                "Corefile:3 - Error during parsing: Wrong argument count or unexpected line ending after '40s'",
+			"domain example2.com {\n tll 60\n }": "Corefile:4 - Error during parsing: unknown property 'tll' for domain 'example2.com.'",
+			"domain example2.com {\n formats hex\n }": "Corefile:4 - Error during parsing: unknown format: 'hex'",
+			"domain 127.0.0.1":                        "Corefile:3 - Error during parsing: '127.0.0.1' is not a valid domain name",
+		} {
+			dispenser := caddyfile.NewDispenser("Corefile", buffer.NewReader([]byte("{\ndomain example1.com\n"+block+"\n}")))
+			config, err := newConfigFromDispenser(dispenser)
+			require.EqualError(t, err, expected, block)
+			require.Nil(t, config)
+		}
+	})
+	t.Run("IDN", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain Bücher.example
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"xn--bcher-kva.example."}, config.domainNames())
+	})
+	t.Run("Fallthrough", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain example1.com
+				fallthrough example1.com
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"example1.com."}, config.Fall.Zones)
+
+		dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain example1.com
+				fallthrough
+			}
+		`)))
+		config, err = newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"."}, config.Fall.Zones)
+	})
+	t.Run("Static Records", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain example1.com {
+					record @ A 192.0.2.1
+					record _dmarc TXT "v=DMARC1; p=reject"
+				}
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"@ A 192.0.2.1", `_dmarc TXT "v=DMARC1; p=reject"`}, config.Domains[0].RecordLines)
+		require.Equal(t, 1, len(config.Domains[0].Records["example1.com."]))
+		require.Equal(t, 1, len(config.Domains[0].Records["_dmarc.example1.com."]))
+
+		for _, block := range []string{
+			"domain example1.com {\n record www A\n }",
+			"domain example1.com {\n record www A 192.0.2.256\n }",
+			"domain example1.com {\n hosts /does/not/exist\n }",
+		} {
+			dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte("{\n"+block+"\n}")))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, block)
+			require.Nil(t, config)
+		}
+	})
 }
@@ -0,0 +1,260 @@
+package ipecho
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxKeyTTL caps the TTL of the DNSKEY, CDS and CDNSKEY sets
+	maxKeyTTL = 3600
+	// signatureInception backdates signatures for clients with a clock that is behind
+	signatureInception = -3 * time.Hour
+	// signatureValidity is how long signatures are valid, answers are signed when they are sent
+	signatureValidity = 8 * 24 * time.Hour
+)
+
+// dnssecKey is a DNSKEY with its private key.
+type dnssecKey struct {
+	K   *dns.DNSKEY
+	S   crypto.Signer
+	tag uint16
+}
+
+// isKSK reports whether k has the secure entry point flag.
+func (k *dnssecKey) isKSK() bool {
+	return k.K.Flags&dns.SEP != 0
+}
+
+// signer signs the answers of a domain with the keys of its current key set.
+type signer struct {
+	zone string
+	keys atomic.Value // *keySet
+}
+
+// keySet are the keys of a domain at one point in time.
+// The DNSKEY set is signed with the KSKs and everything else with the ZSKs.
+type keySet struct {
+	// published are the keys in the DNSKEY set
+	published []*dnssecKey
+	ksk       []*dnssecKey
+	zsk       []*dnssecKey
+	// cds are the KSKs published as CDS and CDNSKEY for the parent, empty if the keys are not rolled over
+	cds []*dnssecKey
+}
+
+func (s *signer) current() *keySet {
+	return s.keys.Load().(*keySet)
+}
+
+// readKey reads the key pair of a BIND style key file, path can name the .key or the .private file or the
+// common prefix of both.
+func readKey(path string) (*dnssecKey, error) {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+
+	pub, err := os.Open(path + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, path+".key")
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key does not contain a DNSKEY", path)
+	}
+
+	priv, err := os.Open(path + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer priv.Close()
+	p, err := key.ReadPrivateKey(priv, path+".private")
+	if err != nil {
+		return nil, err
+	}
+	s, ok := p.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private does not contain a supported private key", path)
+	}
+	return &dnssecKey{K: key, S: s, tag: key.KeyTag()}, nil
+}
+
+// newSigner reads the key files of zone. A zone with only KSKs or only ZSKs uses its keys for both.
+func newSigner(zone string, files []string) (*signer, error) {
+	set := &keySet{}
+	for _, file := range files {
+		k, err := readKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read dnssec key: %w", err)
+		}
+		if !strings.EqualFold(k.K.Header().Name, zone) {
+			return nil, fmt.Errorf("dnssec key '%s' is for '%s' and not for '%s'", file, k.K.Header().Name, zone)
+		}
+		set.published = append(set.published, k)
+		if k.isKSK() {
+			set.ksk = append(set.ksk, k)
+		} else {
+			set.zsk = append(set.zsk, k)
+		}
+	}
+	if len(set.ksk) == 0 {
+		set.ksk = set.zsk
+	}
+	if len(set.zsk) == 0 {
+		set.zsk = set.ksk
+	}
+	if len(set.zsk) == 0 {
+		return nil, fmt.Errorf("at least one dnssec key is needed")
+	}
+	s := &signer{zone: zone}
+	s.keys.Store(set)
+	return s, nil
+}
+
+// loadKeys reads the key files of d into d.Keys.
+func (d *domainConfig) loadKeys() error {
+	d.Keys = nil
+	if d.Rollover != nil {
+		d.Keys = d.Rollover.signer
+		return nil
+	}
+	if len(d.KeyFiles) == 0 {
+		return nil
+	}
+	keys, err := newSigner(d.Name, d.KeyFiles)
+	if err != nil {
+		return err
+	}
+	d.Keys = keys
+	return nil
+}
+
+// types returns the record types the keys add to the apex of the zone.
+func (s *signer) types() []uint16 {
+	if len(s.current().cds) > 0 {
+		return []uint16{dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY}
+	}
+	return []uint16{dns.TypeDNSKEY}
+}
+
+// apex returns the DNSKEY, CDS or CDNSKEY set of the zone for qtype, nil for any other type.
+// Their TTL is capped so key changes propagate within the rollover margins.
+func (s *signer) apex(qtype uint16, ttl uint32) []dns.RR {
+	if ttl > maxKeyTTL {
+		ttl = maxKeyTTL
+	}
+	set := s.current()
+	hdr := dns.RR_Header{Name: s.zone, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+	var rrs []dns.RR
+	switch qtype {
+	case dns.TypeDNSKEY:
+		for _, k := range set.published {
+			key := *k.K
+			key.Hdr = hdr
+			rrs = append(rrs, &key)
+		}
+	case dns.TypeCDS:
+		for _, k := range set.cds {
+			cds := k.K.ToDS(dns.SHA256).ToCDS()
+			cds.Hdr = hdr
+			rrs = append(rrs, cds)
+		}
+	case dns.TypeCDNSKEY:
+		for _, k := range set.cds {
+			cdnskey := k.K.ToCDNSKEY()
+			cdnskey.Hdr = hdr
+			rrs = append(rrs, cdnskey)
+		}
+	}
+	return rrs
+}
+
+// sign returns the signatures of rrset, all records of rrset have the same owner, type and TTL.
+func (s *signer) sign(rrset []dns.RR, now time.Time) ([]dns.RR, error) {
+	set := s.current()
+	keys := set.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		keys = set.ksk
+	}
+	sigs := make([]dns.RR, 0, len(keys))
+	for _, k := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.K.Algorithm,
+			SignerName: s.zone,
+			KeyTag:     k.tag,
+			Inception:  uint32(now.Add(signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(k.S, rrset); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// signSection returns rrs followed by the signatures of the RRsets that belong to a signed domain of cfg.
+func (cfg *config) signSection(rrs []dns.RR, now time.Time) ([]dns.RR, error) {
+	type key struct {
+		name   string
+		rrtype uint16
+	}
+	var order []key
+	sets := map[key][]dns.RR{}
+	for _, rr := range rrs {
+		k := key{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	signed := append([]dns.RR{}, rrs...)
+	for _, k := range order {
+		domain, alias, _ := cfg.match(k.name)
+		if domain == nil || alias != nil || domain.Keys == nil || k.rrtype == dns.TypeRRSIG {
+			continue
+		}
+		sigs, err := domain.Keys.sign(sets[k], now)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, sigs...)
+	}
+	return signed, nil
+}
+
+// blackLie returns the NSEC record that denies qtype at qname. The NSEC covers only qname itself, so a name
+// that does not exist is answered like a name without the type ("black lies") and the zone cannot be walked.
+func blackLie(qname string, qtype uint16, types []uint16, ttl uint32) *dns.NSEC {
+	bitmap := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	for _, t := range types {
+		if t != qtype {
+			bitmap = append(bitmap, t)
+		}
+	}
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	unique := bitmap[:1]
+	for _, t := range bitmap[1:] {
+		if t != unique[len(unique)-1] {
+			unique = append(unique, t)
+		}
+	}
+	name := strings.ToLower(qname)
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: unique,
+	}
+}
@@ -0,0 +1,132 @@
+package ipecho
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKey generates a key for zone and writes it as BIND style key files, it returns the common prefix.
+func writeKey(t *testing.T, zone string, flags uint16) (string, *dns.DNSKEY) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	prefix := filepath.Join(t.TempDir(), "K"+zone+"+013+"+dns.TypeToString[dns.TypeDNSKEY])
+	require.NoError(t, os.WriteFile(prefix+".key", []byte(key.String()+"\n"), 0o600))
+	require.NoError(t, os.WriteFile(prefix+".private", []byte(key.PrivateKeyString(priv)), 0o600))
+	return prefix, key
+}
+
+func TestServeDNSDNSSEC(t *testing.T) {
+	kskFile, ksk := writeKey(t, "example1.com.", dns.ZONE|dns.SEP)
+	zskFile, zsk := writeKey(t, "example1.com.", dns.ZONE)
+
+	d := &domainConfig{
+		Name:        "example1.com.",
+		RecordLines: []string{"www TXT hello"},
+		KeyFiles:    []string{kskFile + ".key", zskFile},
+	}
+	require.NoError(t, d.loadRecords())
+	require.NoError(t, d.loadKeys())
+	p := ipecho{
+		Config: &config{
+			Domains:       []*domainConfig{d, {Name: "example2.com."}},
+			domainOptions: domainOptions{TTL: 60},
+		},
+	}
+
+	query := func(name string, qtype uint16, do bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		if do {
+			r.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		w := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0]
+	}
+	verify := func(key *dns.DNSKEY, sig dns.RR, rrset ...dns.RR) {
+		rrsig, ok := sig.(*dns.RRSIG)
+		require.True(t, ok, "%s is not an RRSIG", sig)
+		require.Equal(t, key.KeyTag(), rrsig.KeyTag)
+		require.NoError(t, rrsig.Verify(key, rrset))
+		require.True(t, rrsig.ValidityPeriod(time.Now()))
+	}
+
+	t.Run("Unsigned Without DO", func(t *testing.T) {
+		m := query("127.0.0.1.example1.com.", dns.TypeA, false)
+		require.Equal(t, 1, len(m.Answer))
+		require.Nil(t, m.IsEdns0())
+	})
+
+	t.Run("Signed Answer", func(t *testing.T) {
+		m := query("127.0.0.1.example1.com.", dns.TypeA, true)
+		require.Equal(t, 2, len(m.Answer))
+		verify(zsk, m.Answer[1], m.Answer[0])
+		require.True(t, m.IsEdns0().Do())
+	})
+
+	t.Run("DNSKEY", func(t *testing.T) {
+		m := query("example1.com.", dns.TypeDNSKEY, true)
+		require.Equal(t, 3, len(m.Answer))
+		verify(ksk, m.Answer[2], m.Answer[0], m.Answer[1])
+
+		m = query("example1.com.", dns.TypeDNSKEY, false)
+		require.Equal(t, 2, len(m.Answer))
+	})
+
+	t.Run("Black Lie For Missing Name", func(t *testing.T) {
+		m := query("test.example1.com.", dns.TypeA, true)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Equal(t, 4, len(m.Ns))
+		verify(zsk, m.Ns[2], m.Ns[0])
+		nsec := m.Ns[1].(*dns.NSEC)
+		require.Equal(t, "test.example1.com.", nsec.Header().Name)
+		require.Equal(t, "\\000.test.example1.com.", nsec.NextDomain)
+		require.Equal(t, []uint16{dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap)
+		verify(zsk, m.Ns[3], nsec)
+
+		m = query("test.example1.com.", dns.TypeA, false)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+	})
+
+	t.Run("Black Lie For Missing Type", func(t *testing.T) {
+		m := query("www.example1.com.", dns.TypeA, true)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Equal(t, []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}, m.Ns[1].(*dns.NSEC).TypeBitMap)
+
+		m = query("::1.example1.com.", dns.TypeTXT, true)
+		require.Equal(t, []uint16{dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeSVCB, dns.TypeHTTPS}, m.Ns[1].(*dns.NSEC).TypeBitMap)
+
+		m = query("example1.com.", dns.TypeA, true)
+		require.Equal(t, []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}, m.Ns[1].(*dns.NSEC).TypeBitMap)
+	})
+
+	t.Run("Unsigned Domain", func(t *testing.T) {
+		m := query("127.0.0.1.example2.com.", dns.TypeA, true)
+		require.Equal(t, 1, len(m.Answer))
+
+		m = query("test.example2.com.", dns.TypeA, true)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+		require.Equal(t, 1, len(m.Ns))
+	})
+
+	t.Run("Invalid Keys", func(t *testing.T) {
+		other, _ := writeKey(t, "example2.com.", dns.ZONE)
+		d := &domainConfig{Name: "example1.com.", KeyFiles: []string{other}}
+		require.Error(t, d.loadKeys())
+		d.KeyFiles = []string{filepath.Join(t.TempDir(), "missing")}
+		require.Error(t, d.loadKeys())
+	})
+}
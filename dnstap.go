@@ -0,0 +1,168 @@
+package ipecho
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// tapDropInterval is the least time between two reports of dropped frames.
+const tapDropInterval = time.Minute
+
+// tapper emits dnstap AUTH_QUERY/AUTH_RESPONSE frames for every answer ipecho synthesizes.
+type tapper struct {
+	// dropped counts the frames dropped since the last report, reported is the time of it in unix nanoseconds.
+	// They come first to be 64-bit aligned for atomic access.
+	dropped  uint64
+	reported int64
+
+	output *dnstap.FrameStreamSockOutput
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newTapper(endpoint string) (*tapper, error) {
+	addr, err := parseTapEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	output, err := dnstap.NewFrameStreamSockOutput(addr)
+	if err != nil {
+		return nil, err
+	}
+	//nolint: gomnd // flush frames at least every second
+	output.SetFlushTimeout(time.Second)
+	return &tapper{output: output}, nil
+}
+
+// parseTapEndpoint accepts unix:///path, tcp://host:port or a plain socket path.
+func parseTapEndpoint(endpoint string) (net.Addr, error) {
+	switch {
+	case strings.HasPrefix(endpoint, "tcp://"):
+		addr, err := net.ResolveTCPAddr("tcp", strings.TrimPrefix(endpoint, "tcp://"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dnstap endpoint '%s': %w", endpoint, err)
+		}
+		return addr, nil
+	case strings.HasPrefix(endpoint, "unix://"):
+		endpoint = strings.TrimPrefix(endpoint, "unix://")
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("invalid dnstap endpoint: socket path is empty")
+	}
+	return &net.UnixAddr{Name: endpoint, Net: "unix"}, nil
+}
+
+func (t *tapper) start() error {
+	go t.output.RunOutputLoop()
+	return nil
+}
+
+func (t *tapper) stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.output.Close()
+		if dropped := atomic.SwapUint64(&t.dropped, 0); dropped > 0 {
+			log.Printf("[ipecho] dnstap output was full, dropped %d frames\n", dropped)
+		}
+	}
+	return nil
+}
+
+// tap sends the query and the synthesized response as a pair of frames.
+func (t *tapper) tap(w dns.ResponseWriter, query *dns.Msg, queryTime time.Time, response *dns.Msg) {
+	queryPacked, err := query.Pack()
+	if err != nil {
+		log.Printf("[ipecho] Unable to pack query for dnstap: %v\n", err)
+		return
+	}
+	responsePacked, err := response.Pack()
+	if err != nil {
+		log.Printf("[ipecho] Unable to pack response for dnstap: %v\n", err)
+		return
+	}
+
+	q := t.newMessage(dnstap.Message_AUTH_QUERY, w)
+	q.QueryTimeSec, q.QueryTimeNsec = tapTime(queryTime)
+	q.QueryMessage = queryPacked
+	t.send(q)
+
+	r := t.newMessage(dnstap.Message_AUTH_RESPONSE, w)
+	r.QueryTimeSec, r.QueryTimeNsec = tapTime(queryTime)
+	r.ResponseTimeSec, r.ResponseTimeNsec = tapTime(time.Now())
+	r.ResponseMessage = responsePacked
+	t.send(r)
+}
+
+func (*tapper) newMessage(typ dnstap.Message_Type, w dns.ResponseWriter) *dnstap.Message {
+	m := &dnstap.Message{Type: &typ}
+
+	var protocol dnstap.SocketProtocol
+	var ip net.IP
+	var port int
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		protocol, ip, port = dnstap.SocketProtocol_UDP, addr.IP, addr.Port
+	case *net.TCPAddr:
+		protocol, ip, port = dnstap.SocketProtocol_TCP, addr.IP, addr.Port
+	default:
+		return m
+	}
+	family := dnstap.SocketFamily_INET6
+	if ip4 := ip.To4(); ip4 != nil {
+		family, ip = dnstap.SocketFamily_INET, ip4
+	}
+	queryPort := uint32(port)
+	m.SocketFamily = &family
+	m.SocketProtocol = &protocol
+	m.QueryAddress = ip
+	m.QueryPort = &queryPort
+	return m
+}
+
+func (t *tapper) send(m *dnstap.Message) {
+	typ := dnstap.Dnstap_MESSAGE
+	frame, err := proto.Marshal(&dnstap.Dnstap{Type: &typ, Message: m})
+	if err != nil {
+		log.Printf("[ipecho] Unable to marshal dnstap frame: %v\n", err)
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	// never block a query because the collector is slow or gone
+	select {
+	case t.output.GetOutputChannel() <- frame:
+	default:
+		t.drop(time.Now())
+	}
+}
+
+// drop counts a dropped frame, the count is logged at most once per tapDropInterval so a slow collector does not
+// flood the log.
+func (t *tapper) drop(now time.Time) {
+	atomic.AddUint64(&t.dropped, 1)
+	last := atomic.LoadInt64(&t.reported)
+	if now.UnixNano()-last < int64(tapDropInterval) || !atomic.CompareAndSwapInt64(&t.reported, last, now.UnixNano()) {
+		return
+	}
+	log.Printf("[ipecho] dnstap output is full, dropped %d frames\n", atomic.SwapUint64(&t.dropped, 0))
+}
+
+func tapTime(ts time.Time) (*uint64, *uint32) {
+	sec, nsec := uint64(ts.Unix()), uint32(ts.Nanosecond())
+	return &sec, &nsec
+}
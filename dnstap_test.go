@@ -0,0 +1,119 @@
+package ipecho
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseTapEndpoint(t *testing.T) {
+	addr, err := parseTapEndpoint("unix:///run/dnstap.sock")
+	require.NoError(t, err)
+	require.Equal(t, "unix", addr.Network())
+	require.Equal(t, "/run/dnstap.sock", addr.String())
+
+	addr, err = parseTapEndpoint("/run/dnstap.sock")
+	require.NoError(t, err)
+	require.Equal(t, "/run/dnstap.sock", addr.String())
+
+	addr, err = parseTapEndpoint("tcp://127.0.0.1:6000")
+	require.NoError(t, err)
+	require.Equal(t, "tcp", addr.Network())
+	require.Equal(t, "127.0.0.1:6000", addr.String())
+
+	_, err = parseTapEndpoint("unix://")
+	require.Error(t, err)
+}
+
+func TestDnstap(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ipecho")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "dnstap.sock")
+
+	input, err := dnstap.NewFrameStreamSockInputFromPath(socket)
+	require.NoError(t, err)
+	frames := make(chan []byte, 8)
+	go input.ReadInto(frames)
+
+	tap, err := newTapper("unix://" + socket)
+	require.NoError(t, err)
+	require.NoError(t, tap.start())
+
+	p := ipecho{
+		Config: &config{
+			Domains:       []*domainConfig{{Name: "example1.com."}},
+			domainOptions: domainOptions{TTL: 60},
+		},
+		Tap: tap,
+	}
+	d := &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	p.ServeDNS(context.Background(), d, &dns.Msg{
+		Question: []dns.Question{
+			{
+				Name:   "127.0.0.1.example1.com.",
+				Qclass: dns.ClassINET,
+				Qtype:  dns.TypeA,
+			},
+		},
+	})
+	require.Equal(t, 1, len(d.GetMsgs()))
+	require.NoError(t, tap.stop())
+
+	readFrame := func() *dnstap.Message {
+		select {
+		case frame := <-frames:
+			var dt dnstap.Dnstap
+			require.NoError(t, proto.Unmarshal(frame, &dt))
+			return dt.GetMessage()
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timeout waiting for dnstap frame")
+		}
+		return nil
+	}
+
+	query := readFrame()
+	require.Equal(t, dnstap.Message_AUTH_QUERY, query.GetType())
+	require.Equal(t, dnstap.SocketProtocol_UDP, query.GetSocketProtocol())
+	require.Equal(t, net.ParseIP("192.0.2.1").To4(), net.IP(query.GetQueryAddress()))
+	require.Equal(t, uint32(5353), query.GetQueryPort())
+	require.NotEmpty(t, query.GetQueryMessage())
+
+	response := readFrame()
+	require.Equal(t, dnstap.Message_AUTH_RESPONSE, response.GetType())
+	var m dns.Msg
+	require.NoError(t, m.Unpack(response.GetResponseMessage()))
+	require.Equal(t, 1, len(m.Answer))
+	require.Equal(t, net.ParseIP("127.0.0.1").To4(), m.Answer[0].(*dns.A).A.To4())
+}
+
+func TestDnstapDrops(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	tap, err := newTapper("unix://" + filepath.Join(t.TempDir(), "dnstap.sock"))
+	require.NoError(t, err)
+	// without the output loop nobody reads the frames, so they are dropped once the channel is full
+	typ := dnstap.Message_AUTH_QUERY
+	for i := 0; i < 1000; i++ {
+		tap.send(&dnstap.Message{Type: &typ})
+	}
+	require.Equal(t, 1, strings.Count(out.String(), "dropped"), "drops are reported once per interval")
+	require.NotZero(t, tap.dropped)
+
+	tap.drop(time.Now().Add(tapDropInterval))
+	require.Equal(t, 2, strings.Count(out.String(), "dropped"))
+	require.Zero(t, tap.dropped)
+}
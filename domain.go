@@ -0,0 +1,532 @@
+package ipecho
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// format is a set of encodings an address can be embedded with.
+type format uint8
+
+const (
+	// formatDotted is the address as it is written, e.g. 10.0.0.1.example.com or ::1.example.com
+	formatDotted format = 1 << iota
+	// formatDash is the address with dashes instead of dots or colons in the label in front of the
+	// domain, e.g. 10-0-0-1.example.com or app.2001-db8--1.example.com
+	formatDash
+
+	defaultFormats = formatDotted
+)
+
+// family is a set of address families that are answered.
+type family uint8
+
+const (
+	familyV4 family = 1 << iota
+	familyV6
+
+	defaultFamilies = familyV4 | familyV6
+)
+
+// option marks a setting that was given explicitly for a domain.
+type option uint16
+
+const (
+	optionTTL option = 1 << iota
+	optionFormats
+	optionFamilies
+	optionAllow
+	optionDeny
+	optionNAT
+	optionDefault
+	optionTransfer
+	optionEnumerate
+	optionUpdate
+	optionSafeguards
+	optionALPN
+	optionPort
+	optionMX
+)
+
+// domainOptions are the settings that can be given at the plugin level and for every single domain.
+type domainOptions struct {
+	// TTL to use for response
+	TTL uint32
+	// Formats the address can be embedded with
+	Formats format
+	// Families of the addresses that are answered
+	Families family
+	// Allow lists the networks that are answered, all networks are answered if empty
+	Allow []*net.IPNet
+	// Deny lists the networks that are never answered
+	Deny []*net.IPNet
+	// NAT translates the answered addresses, the policy applies to the address in the name
+	NAT []natMapping
+	// Default are the addresses answered for names without an embedded address
+	Default []net.IP
+	// Transfer lists the networks of the clients that may transfer the domain
+	Transfer []*net.IPNet
+	// TransferKeys lists the TSIG keys a transfer has to be signed with, any key if empty
+	TransferKeys []string
+	// Enumerate lists the networks whose addresses are included in transfers
+	Enumerate []*net.IPNet
+	// Update lists the TSIG keys that may update the domain
+	Update []string
+	// Safeguards are answered at the apex and every synthesized name, nil disables them
+	Safeguards *safeguardPolicy
+	// ALPN are the protocol ids of the synthesized HTTPS and SVCB records
+	ALPN []string
+	// Port of the synthesized HTTPS and SVCB records, 0 leaves it out
+	Port uint16
+	// MX answers MX queries for names with an embedded address with the name itself
+	MX bool
+}
+
+// domainConfig is a domain we react to.
+type domainConfig struct {
+	// Name of the domain, lower cased and fully qualified
+	Name string
+	domainOptions
+	// set holds the options that were given for this domain, all other options are inherited
+	set option
+	// RecordLines are the static records in zone file syntax, relative to the domain
+	RecordLines []string
+	// Hosts is the path of a hosts file with static records
+	Hosts string
+	// Records are the static records parsed from RecordLines and Hosts
+	Records staticRecords
+	// Templates render the answers for names with an embedded address, keyed by record type
+	Templates answerTemplates
+	// KeyFiles are the DNSSEC key files of the domain, the answers are signed if there are any
+	KeyFiles []string
+	// Rollover generates and rolls over the keys of the domain instead of KeyFiles, nil if the keys are static
+	Rollover *keyManager
+	// Keys sign the answers, nil if the domain is not signed
+	Keys *signer
+}
+
+// effectiveOptions returns the options of d, options not set for d are inherited from the plugin level.
+func (cfg *config) effectiveOptions(d *domainConfig) domainOptions {
+	opts := cfg.domainOptions
+	opts.override(&d.domainOptions, d.set)
+	if opts.Formats == 0 {
+		opts.Formats = defaultFormats
+	}
+	if opts.Families == 0 {
+		opts.Families = defaultFamilies
+	}
+	return opts
+}
+
+// override replaces the options in set with the ones of src.
+func (opts *domainOptions) override(src *domainOptions, set option) {
+	if set&optionTTL != 0 {
+		opts.TTL = src.TTL
+	}
+	if set&optionFormats != 0 {
+		opts.Formats = src.Formats
+	}
+	if set&optionFamilies != 0 {
+		opts.Families = src.Families
+	}
+	if set&optionAllow != 0 {
+		opts.Allow = src.Allow
+	}
+	if set&optionDeny != 0 {
+		opts.Deny = src.Deny
+	}
+	if set&optionNAT != 0 {
+		opts.NAT = src.NAT
+	}
+	if set&optionDefault != 0 {
+		opts.Default = src.Default
+	}
+	if set&optionTransfer != 0 {
+		opts.Transfer, opts.TransferKeys = src.Transfer, src.TransferKeys
+	}
+	if set&optionEnumerate != 0 {
+		opts.Enumerate = src.Enumerate
+	}
+	if set&optionUpdate != 0 {
+		opts.Update = src.Update
+	}
+	if set&optionSafeguards != 0 {
+		opts.Safeguards = src.Safeguards
+	}
+	if set&optionALPN != 0 {
+		opts.ALPN = src.ALPN
+	}
+	if set&optionPort != 0 {
+		opts.Port = src.Port
+	}
+	if set&optionMX != 0 {
+		opts.MX = src.MX
+	}
+}
+
+// decode returns the address embedded in subdomain using the formats in opts.
+// subdomain is the part of the query name in front of the domain, without the trailing dot.
+func (opts *domainOptions) decode(subdomain string) net.IP {
+	if opts.Formats&formatDotted != 0 {
+		if ip := net.ParseIP(subdomain); ip != nil {
+			return ip
+		}
+	}
+	if opts.Formats&formatDash != 0 {
+		return decodeDash(subdomain[strings.LastIndexByte(subdomain, '.')+1:])
+	}
+	return nil
+}
+
+// decodeDash returns the address of a label in the dash format.
+func decodeDash(label string) net.IP {
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ":")); ip != nil && ip.To4() == nil {
+		return ip
+	}
+	return nil
+}
+
+// answers reports whether ip may be answered with opts.
+func (opts *domainOptions) answers(ip net.IP) (bool, string) {
+	if ip.To4() != nil {
+		if opts.Families&familyV4 == 0 {
+			return false, "family not allowed"
+		}
+	} else if opts.Families&familyV6 == 0 {
+		return false, "family not allowed"
+	}
+	for _, n := range opts.Deny {
+		if n.Contains(ip) {
+			return false, "denied"
+		}
+	}
+	if len(opts.Allow) == 0 {
+		return true, "allowed"
+	}
+	for _, n := range opts.Allow {
+		if n.Contains(ip) {
+			return true, "allowed"
+		}
+	}
+	return false, "not allowed"
+}
+
+func parseFormats(args []string) (format, error) {
+	var f format
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "dotted":
+			f |= formatDotted
+		case "dash":
+			f |= formatDash
+		default:
+			return 0, fmt.Errorf("unknown format: '%s'", arg)
+		}
+	}
+	if f == 0 {
+		return 0, fmt.Errorf("formats needs at least one format")
+	}
+	return f, nil
+}
+
+func (f format) strings() []string {
+	var s []string
+	if f&formatDotted != 0 {
+		s = append(s, "dotted")
+	}
+	if f&formatDash != 0 {
+		s = append(s, "dash")
+	}
+	return s
+}
+
+func parseFamilies(args []string) (family, error) {
+	var f family
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "v4", "ipv4":
+			f |= familyV4
+		case "v6", "ipv6":
+			f |= familyV6
+		default:
+			return 0, fmt.Errorf("unknown family: '%s'", arg)
+		}
+	}
+	if f == 0 {
+		return 0, fmt.Errorf("families needs at least one family")
+	}
+	return f, nil
+}
+
+func (f family) strings() []string {
+	var s []string
+	if f&familyV4 != 0 {
+		s = append(s, "v4")
+	}
+	if f&familyV6 != 0 {
+		s = append(s, "v6")
+	}
+	return s
+}
+
+func parseNetworks(args []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(args))
+	for _, arg := range args {
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' is not a valid network", arg)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		networks = append(networks, n)
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("at least one network is needed")
+	}
+	return networks, nil
+}
+
+// parseAddresses parses a list of addresses, IPv4 addresses are kept in their 4 byte form.
+func parseAddresses(args []string) ([]net.IP, error) {
+	addresses := make([]net.IP, 0, len(args))
+	for _, arg := range args {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("'%s' is not a valid address", arg)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		addresses = append(addresses, ip)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("at least one address is needed")
+	}
+	return addresses, nil
+}
+
+func addressStrings(addresses []net.IP) []string {
+	s := make([]string, 0, len(addresses))
+	for _, ip := range addresses {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+func networkStrings(networks []*net.IPNet) []string {
+	s := make([]string, 0, len(networks))
+	for _, n := range networks {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+// domainSpec is a domain with its options as it is written in the file or sent to the admin API.
+type domainSpec struct {
+	Name     string   `json:"name" yaml:"name"`
+	TTL      *uint32  `json:"ttl,omitempty" yaml:"ttl"`
+	Formats  []string `json:"formats,omitempty" yaml:"formats"`
+	Families []string `json:"families,omitempty" yaml:"families"`
+	Allow    []string `json:"allow,omitempty" yaml:"allow"`
+	Deny     []string `json:"deny,omitempty" yaml:"deny"`
+	NAT      []string `json:"nat,omitempty" yaml:"nat"`
+	Default  []string `json:"default,omitempty" yaml:"default"`
+	// Transfer lists networks, optionally followed by "key" and the names of the TSIG keys transfers need
+	Transfer []string `json:"transfer,omitempty" yaml:"transfer"`
+	// Enumerate lists networks of at most 1024 addresses
+	Enumerate []string `json:"enumerate,omitempty" yaml:"enumerate"`
+	// Update lists the names of the TSIG keys that may update the domain
+	Update []string `json:"update,omitempty" yaml:"update"`
+	// Safeguards lists the CAs of the CAA records, or is "none" or "off"
+	Safeguards []string `json:"safeguards,omitempty" yaml:"safeguards"`
+	ALPN       []string `json:"alpn,omitempty" yaml:"alpn"`
+	Port       *uint16  `json:"port,omitempty" yaml:"port"`
+	MX         *bool    `json:"mx,omitempty" yaml:"mx"`
+	Records    []string `json:"records,omitempty" yaml:"records"`
+	Hosts      string   `json:"hosts,omitempty" yaml:"hosts"`
+	// Templates are keyed by the record type
+	Templates map[string]string `json:"templates,omitempty" yaml:"templates"`
+	DNSSEC    []string          `json:"dnssec,omitempty" yaml:"dnssec"`
+}
+
+func (s *domainSpec) domainConfig() (*domainConfig, error) {
+	name, err := normalizeDomain(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	d := &domainConfig{Name: name}
+	if s.TTL != nil {
+		if *s.TTL > maxTTL {
+			return nil, fmt.Errorf("TTL value '%d' is larger than %d", *s.TTL, maxTTL)
+		}
+		d.TTL = *s.TTL
+		d.set |= optionTTL
+	}
+	if s.Formats != nil {
+		if d.Formats, err = parseFormats(s.Formats); err != nil {
+			return nil, err
+		}
+		d.set |= optionFormats
+	}
+	if s.Families != nil {
+		if d.Families, err = parseFamilies(s.Families); err != nil {
+			return nil, err
+		}
+		d.set |= optionFamilies
+	}
+	if s.Allow != nil {
+		if d.Allow, err = parseNetworks(s.Allow); err != nil {
+			return nil, err
+		}
+		d.set |= optionAllow
+	}
+	if s.Deny != nil {
+		if d.Deny, err = parseNetworks(s.Deny); err != nil {
+			return nil, err
+		}
+		d.set |= optionDeny
+	}
+	if s.NAT != nil {
+		for _, line := range s.NAT {
+			fields := strings.Fields(line)
+			//nolint: gomnd // from and to
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid nat mapping '%s'", line)
+			}
+			m, err := parseNATMapping(fields[0], fields[1])
+			if err != nil {
+				return nil, err
+			}
+			d.NAT = append(d.NAT, m)
+		}
+		d.set |= optionNAT
+	}
+	if s.Default != nil {
+		if d.Default, err = parseAddresses(s.Default); err != nil {
+			return nil, err
+		}
+		d.set |= optionDefault
+	}
+	if s.Transfer != nil {
+		if _, err = parseTransferOption(s.Transfer, &d.domainOptions); err != nil {
+			return nil, err
+		}
+		d.set |= optionTransfer
+	}
+	if s.Enumerate != nil {
+		if _, err = parseEnumerateOption(s.Enumerate, &d.domainOptions); err != nil {
+			return nil, err
+		}
+		d.set |= optionEnumerate
+	}
+	if s.Update != nil {
+		if _, err = parseUpdateOption(s.Update, &d.domainOptions); err != nil {
+			return nil, err
+		}
+		d.set |= optionUpdate
+	}
+	if s.Safeguards != nil {
+		if _, err = parseSafeguardsOption(s.Safeguards, &d.domainOptions); err != nil {
+			return nil, err
+		}
+		d.set |= optionSafeguards
+	}
+	if s.ALPN != nil {
+		if _, err = parseALPNOption(s.ALPN, &d.domainOptions); err != nil {
+			return nil, err
+		}
+		d.set |= optionALPN
+	}
+	if s.Port != nil {
+		if *s.Port == 0 {
+			return nil, fmt.Errorf("invalid port: '0'")
+		}
+		d.Port = *s.Port
+		d.set |= optionPort
+	}
+	if s.MX != nil {
+		d.MX = *s.MX
+		d.set |= optionMX
+	}
+	if d.Templates, err = parseAnswerTemplates(d.Name, s.Templates); err != nil {
+		return nil, err
+	}
+	d.RecordLines, d.Hosts = s.Records, s.Hosts
+	if err := d.loadRecords(); err != nil {
+		return nil, err
+	}
+	if len(s.DNSSEC) > 0 && strings.EqualFold(s.DNSSEC[0], "auto") {
+		return nil, fmt.Errorf("automatic key rollover can only be configured in the Corefile")
+	}
+	d.KeyFiles = s.DNSSEC
+	if err := d.loadKeys(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *domainConfig) spec() domainSpec {
+	s := domainSpec{Name: d.Name}
+	if d.set&optionTTL != 0 {
+		ttl := d.TTL
+		s.TTL = &ttl
+	}
+	if d.set&optionFormats != 0 {
+		s.Formats = d.Formats.strings()
+	}
+	if d.set&optionFamilies != 0 {
+		s.Families = d.Families.strings()
+	}
+	if d.set&optionAllow != 0 {
+		s.Allow = networkStrings(d.Allow)
+	}
+	if d.set&optionDeny != 0 {
+		s.Deny = networkStrings(d.Deny)
+	}
+	if d.set&optionNAT != 0 {
+		s.NAT = natStrings(d.NAT)
+	}
+	if d.set&optionDefault != 0 {
+		s.Default = addressStrings(d.Default)
+	}
+	if d.set&optionTransfer != 0 {
+		s.Transfer = d.transferStrings()
+	}
+	if d.set&optionEnumerate != 0 {
+		s.Enumerate = networkStrings(d.Enumerate)
+	}
+	if d.set&optionUpdate != 0 {
+		s.Update = d.Update
+	}
+	if d.set&optionSafeguards != 0 {
+		s.Safeguards = d.Safeguards.strings()
+	}
+	if d.set&optionALPN != 0 {
+		s.ALPN = d.ALPN
+	}
+	if d.set&optionPort != 0 {
+		port := d.Port
+		s.Port = &port
+	}
+	if d.set&optionMX != 0 {
+		mx := d.MX
+		s.MX = &mx
+	}
+	s.Records, s.Hosts = d.RecordLines, d.Hosts
+	s.Templates = d.Templates.texts()
+	s.DNSSEC = d.KeyFiles
+	if d.Rollover != nil {
+		s.DNSSEC = d.Rollover.args()
+	}
+	return s
+}
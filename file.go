@@ -0,0 +1,168 @@
+package ipecho
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultFileReload = 30 * time.Second
+
+// fileConfig is the layout of the file loaded with the file directive.
+type fileConfig struct {
+	Domains []domainSpec `yaml:"domains"`
+}
+
+// fileLoader merges the domains of a YAML file into the config and reloads them when the file changes.
+// A file that cannot be loaded leaves the previous config in place and makes the plugin report not ready.
+// Domains from the Corefile or the admin API are kept on every load, the file only adds and replaces its own ones.
+type fileLoader struct {
+	path     string
+	interval time.Duration
+	store    *configStore
+	// loaded are the domains the last successful load added, by name
+	loaded map[string]*domainConfig
+	// released are the names of file domains that were replaced or removed through the admin API, the file does
+	// not add them again
+	released map[string]bool
+
+	healthy int32
+	hash    [sha256.Size]byte
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newFileLoader(path string, interval time.Duration, store *configStore) *fileLoader {
+	return &fileLoader{
+		path:     path,
+		interval: interval,
+		store:    store,
+		released: map[string]bool{},
+		done:     make(chan struct{}),
+	}
+}
+
+// load reads the file and merges its domains into the current config if the file changed since the last
+// successful load.
+func (f *fileLoader) load() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return f.fail(err)
+	}
+	hash := sha256.Sum256(data)
+	if atomic.LoadInt32(&f.healthy) == 1 && hash == f.hash {
+		return nil
+	}
+
+	domains, err := f.parse(data)
+	if err != nil {
+		return f.fail(err)
+	}
+	loaded := make(map[string]*domainConfig, len(domains))
+	released := make(map[string]bool, len(f.released))
+	for name := range f.released {
+		released[name] = true
+	}
+	err = f.store.Update(func(cfg *config) error {
+		for name, d := range f.loaded {
+			if cfg.findDomain(name) != d {
+				released[name] = true
+				continue
+			}
+			cfg.removeDomain(name)
+		}
+		for _, d := range domains {
+			if released[d.Name] {
+				continue
+			}
+			// a domain that is also given in the Corefile or added through the admin API is left alone
+			if cfg.addDomain(d) {
+				loaded[d.Name] = d
+			}
+		}
+		if len(cfg.Domains) == 0 {
+			return fmt.Errorf("there is no domain to handle")
+		}
+		if err := cfg.checkUpdates(); err != nil {
+			return err
+		}
+		if err := cfg.checkTransferKeys(); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return f.fail(err)
+	}
+	f.loaded, f.released = loaded, released
+	f.hash = hash
+	atomic.StoreInt32(&f.healthy, 1)
+	if f.store.Load().Debug {
+		log.Printf("[ipecho] Loaded %d Domains from %s\n", len(loaded), f.path)
+	}
+	return nil
+}
+
+func (f *fileLoader) parse(data []byte) ([]*domainConfig, error) {
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	domains := make([]*domainConfig, 0, len(fc.Domains))
+	for i := range fc.Domains {
+		d, err := fc.Domains[i].domainConfig()
+		if err != nil {
+			return nil, fmt.Errorf("domain #%d: %w", i+1, err)
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+func (f *fileLoader) fail(err error) error {
+	atomic.StoreInt32(&f.healthy, 0)
+	err = fmt.Errorf("unable to load %s: %w", f.path, err)
+	log.Printf("[ipecho] %v, keeping the previous config\n", err)
+	return err
+}
+
+// Ready reports whether the last load of the file succeeded.
+func (f *fileLoader) Ready() bool {
+	return atomic.LoadInt32(&f.healthy) == 1
+}
+
+func (f *fileLoader) start() error {
+	// a broken file must not keep coredns from starting, it is reported through Ready
+	_ = f.load()
+	go func() {
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = f.load()
+			case <-f.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *fileLoader) stop() error {
+	f.stopOnce.Do(func() { close(f.done) })
+	return nil
+}
@@ -0,0 +1,174 @@
+package ipecho
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLoader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipecho.yaml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	base := &config{
+		Domains:       []*domainConfig{{Name: "example1.com."}},
+		domainOptions: domainOptions{TTL: 60},
+	}
+	store := newConfigStore(base)
+	p := ipecho{Config: base, Store: store, File: newFileLoader(path, time.Hour, store)}
+
+	t.Run("Missing File", func(t *testing.T) {
+		require.Error(t, p.File.load())
+		require.False(t, p.Ready())
+		require.Equal(t, []string{"example1.com."}, store.Load().domainNames())
+	})
+
+	t.Run("Valid File", func(t *testing.T) {
+		write(`
+domains:
+  - name: example2.com
+    ttl: 30
+    formats: [dash]
+    deny: [10.0.0.0/8]
+  - name: Example3.com.
+  - name: example1.com
+`)
+		require.NoError(t, p.File.load())
+		require.True(t, p.Ready())
+		require.Equal(t, []string{"example1.com.", "example2.com.", "example3.com."}, store.Load().domainNames())
+		require.Equal(t, uint32(60), store.Load().TTL)
+		opts := store.Load().effectiveOptions(store.Load().Domains[1])
+		require.Equal(t, uint32(30), opts.TTL)
+		require.Equal(t, formatDash, opts.Formats)
+		require.Equal(t, []string{"10.0.0.0/8"}, networkStrings(opts.Deny))
+		require.Equal(t, []string{"example1.com."}, base.domainNames())
+	})
+
+	t.Run("Invalid Domain Keeps Previous Config", func(t *testing.T) {
+		write(`
+domains:
+  - name: 127.0.0.1
+`)
+		require.Error(t, p.File.load())
+		require.False(t, p.Ready())
+		require.Equal(t, []string{"example1.com.", "example2.com.", "example3.com."}, store.Load().domainNames())
+
+		write(`
+domains:
+  - name: example2.com
+    transfer: [192.0.2.0/24, key, xfr.]
+`)
+		require.Error(t, p.File.load(), "unknown transfer key")
+
+		write(`
+domains:
+  - name: example2.com
+    update: [ci.]
+`)
+		require.Error(t, p.File.load(), "unknown update key and no dynamic file")
+		require.Equal(t, []string{"example1.com.", "example2.com.", "example3.com."}, store.Load().domainNames())
+	})
+
+	t.Run("Unknown Field Keeps Previous Config", func(t *testing.T) {
+		write(`
+domain:
+  - name: example4.com
+`)
+		require.Error(t, p.File.load())
+		require.False(t, p.Ready())
+		require.Equal(t, []string{"example1.com.", "example2.com.", "example3.com."}, store.Load().domainNames())
+	})
+
+	t.Run("Removed Domain", func(t *testing.T) {
+		write(`
+domains:
+  - name: example3.com
+`)
+		require.NoError(t, p.File.load())
+		require.True(t, p.Ready())
+		require.Equal(t, []string{"example1.com.", "example3.com."}, store.Load().domainNames())
+	})
+
+	t.Run("Static Records", func(t *testing.T) {
+		write(`
+domains:
+  - name: example3.com
+    records:
+      - "www A 192.0.2.1"
+`)
+		require.NoError(t, p.File.load())
+		require.Equal(t, 1, len(store.Load().Domains[1].Records["www.example3.com."]))
+
+		write(`
+domains:
+  - name: example3.com
+    records:
+      - "www A 192.0.2.256"
+`)
+		require.Error(t, p.File.load())
+		require.False(t, p.Ready())
+	})
+
+	t.Run("Keeps Admin Changes", func(t *testing.T) {
+		write(`
+domains:
+  - name: example3.com
+`)
+		require.NoError(t, p.File.load())
+		require.NoError(t, store.Update(func(cfg *config) error {
+			cfg.addDomain(&domainConfig{Name: "example4.com."})
+			return nil
+		}))
+
+		write(`
+domains:
+  - name: example5.com
+`)
+		require.NoError(t, p.File.load())
+		require.True(t, p.Ready())
+		require.Equal(t, []string{"example1.com.", "example4.com.", "example5.com."}, store.Load().domainNames())
+	})
+
+	t.Run("Keeps Admin Replaced And Removed Domains", func(t *testing.T) {
+		write(`
+domains:
+  - name: example5.com
+  - name: example6.com
+  - name: example7.com
+`)
+		require.NoError(t, p.File.load())
+		require.NoError(t, store.Update(func(cfg *config) error {
+			d := &domainConfig{Name: "example5.com.", domainOptions: domainOptions{TTL: 5}, set: optionTTL}
+			cfg.replaceDomain(d)
+			cfg.removeDomain("example6.com.")
+			return nil
+		}))
+
+		write(`
+domains:
+  - name: example5.com
+    ttl: 30
+  - name: example6.com
+    ttl: 30
+  - name: example7.com
+    ttl: 30
+`)
+		require.NoError(t, p.File.load())
+		cfg := store.Load()
+		require.Equal(t, []string{"example1.com.", "example4.com.", "example5.com.", "example7.com."}, cfg.domainNames())
+		require.Equal(t, uint32(5), cfg.effectiveOptions(cfg.findDomain("example5.com.")).TTL)
+		require.Equal(t, uint32(30), cfg.effectiveOptions(cfg.findDomain("example7.com.")).TTL)
+	})
+
+	t.Run("Empty File Without Corefile Domains", func(t *testing.T) {
+		write(``)
+		loader := newFileLoader(path, time.Hour, newConfigStore(&config{domainOptions: domainOptions{TTL: 60}}))
+		require.Error(t, loader.load())
+		require.False(t, loader.Ready())
+	})
+}
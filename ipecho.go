@@ -4,6 +4,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/miekg/dns"
@@ -13,12 +14,25 @@ import (
 type ipecho struct {
 	Next   plugin.Handler
 	Config *config
+	// Store holds the config if it can change at runtime, every query then uses the config current at its start
+	Store *configStore
+	// File loads additional domains from a file, nil if no file is configured
+	File *fileLoader
+	// Tap receives the synthesized answers, nil if dnstap is disabled
+	Tap *tapper
+	// Stats counts the answered queries, nil if statistics are disabled
+	Stats *statistics
+	// Dynamic holds the records of dynamic updates, nil if updates are disabled
+	Dynamic *dynamicRecords
 }
 
 // ServeDNS implements the middleware.Handler interface.
 func (p ipecho) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	if p.echoIP(w, r) {
-		return dns.RcodeSuccess, nil
+	if p.Store != nil {
+		p.Config = p.Store.Load()
+	}
+	if rcode, ok := p.echoIP(ctx, w, r, time.Now()); ok {
+		return rcode, nil
 	}
 	return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
 }
@@ -26,12 +40,33 @@ func (p ipecho) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 // Name implements the Handler interface.
 func (ipecho) Name() string { return "IPEcho" }
 
-func (p *ipecho) echoIP(w dns.ResponseWriter, r *dns.Msg) bool {
+// Ready implements the ready.Readiness interface.
+func (p ipecho) Ready() bool {
+	if p.File != nil {
+		return p.File.Ready()
+	}
+	return true
+}
+
+// echoIP answers r if it is for one of the domains. It reports false if the query should be passed on.
+func (p *ipecho) echoIP(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, queryTime time.Time) (int, bool) {
 	if len(r.Question) == 0 {
-		return false
+		return dns.RcodeSuccess, false
 	}
 
-	var rrs []dns.RR
+	var rrs, extra []dns.RR
+	// the first question is used for a negative answer
+	var negative resolution
+	// the domain of the first answered question tags the written response
+	var answered string
+	view, subnet := p.Config.selectView(w, r)
+
+	if r.Opcode == dns.OpcodeUpdate {
+		return p.update(ctx, w, r)
+	}
+	if qtype := r.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		return p.transfer(ctx, w, r)
+	}
 
 	for i := 0; i < len(r.Question); i++ {
 		question := r.Question[i]
@@ -39,44 +74,20 @@ func (p *ipecho) echoIP(w dns.ResponseWriter, r *dns.Msg) bool {
 			continue
 		}
 
-		if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
-			continue
+		var res resolution
+		if question.Qtype == dns.TypeANY {
+			res = p.resolveAny(ctx, w, &question, view)
+		} else {
+			res = p.resolve(ctx, w, &question, view)
 		}
-		ip := p.parseIP(&question)
-		if ip == nil {
-			if p.Config.Debug {
-				log.Printf("[ipecho] Parsed IP of '%s' is nil\n", question.Name)
-			}
-			continue
+		if i == 0 {
+			negative = res
 		}
-		// not an ip4
-		if ip4 := ip.To4(); ip4 != nil {
-			if p.Config.Debug {
-				log.Printf("[ipecho] Parsed IP of '%s' is an IPv4 address\n", question.Name)
-			}
-			rrs = append(rrs, &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    p.Config.TTL,
-				},
-				A: ip,
-			})
-		} else {
-			if p.Config.Debug {
-				log.Printf("[ipecho] Parsed IP of '%s' is an IPv6 address\n", question.Name)
-			}
-			rrs = append(rrs, &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    p.Config.TTL,
-				},
-				AAAA: ip,
-			})
+		if answered == "" && len(res.answer) > 0 {
+			answered = res.domain.Name
 		}
+		rrs = append(rrs, res.answer...)
+		extra = append(extra, res.extra...)
 	}
 
 	if len(rrs) > 0 {
@@ -85,44 +96,394 @@ func (p *ipecho) echoIP(w dns.ResponseWriter, r *dns.Msg) bool {
 		}
 		m := new(dns.Msg)
 		m.SetReply(r)
+		m.Authoritative = true
 		m.Answer = rrs
-		_ = w.WriteMsg(m)
-		return true
+		m.Extra = extra
+		p.sign(r, m, queryTime)
+		addSubnet(r, m, subnet)
+		p.writeMsg(ctx, w, r, m, answered, queryTime)
+		return dns.RcodeSuccess, true
+	}
+
+	if negative.domain == nil || p.Config.Fall.Through(r.Question[0].Name) {
+		return dns.RcodeSuccess, false
+	}
+	rcode := dns.RcodeNameError
+	if negative.exists {
+		rcode = dns.RcodeSuccess
 	}
-	return false
+	if p.Config.Debug {
+		log.Printf("[ipecho] Answering '%s' with %s\n", r.Question[0].Name, dns.RcodeToString[rcode])
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Authoritative = true
+	soa := p.Config.soa(negative.zone, &negative.opts)
+	m.Ns = []dns.RR{soa}
+	if dnssecOK(r) && negative.zone == negative.domain.Name && negative.domain.Keys != nil {
+		// black lies answer names that do not exist like names without the type
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = append(m.Ns, blackLie(r.Question[0].Name, r.Question[0].Qtype, negative.types, soa.Minttl))
+	}
+	p.sign(r, m, queryTime)
+	addSubnet(r, m, subnet)
+	p.writeMsg(ctx, w, r, m, negative.domain.Name, queryTime)
+	return m.Rcode, true
+}
+
+// dnssecOK reports whether the DO bit of r is set.
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// sign adds the signatures of the signed domains to the sections of m if r has the DO bit set.
+// If signing fails m is sent unsigned.
+func (p *ipecho) sign(r, m *dns.Msg, now time.Time) {
+	if !dnssecOK(r) {
+		return
+	}
+	answer, err := p.Config.signSection(m.Answer, now)
+	var ns, extra []dns.RR
+	if err == nil {
+		ns, err = p.Config.signSection(m.Ns, now)
+	}
+	if err == nil {
+		extra, err = p.Config.signSection(m.Extra, now)
+	}
+	if err == nil {
+		m.Answer, m.Ns, m.Extra = answer, ns, extra
+	}
+	if err != nil {
+		log.Printf("[ipecho] Warning: unable to sign the answer for '%s': %s\n", r.Question[0].Name, err)
+	}
+	m.SetEdns0(r.IsEdns0().UDPSize(), true)
 }
 
-func (p *ipecho) parseIP(question *dns.Question) net.IP {
+// writeMsg writes the response m for the query r to a name of domain.
+func (p *ipecho) writeMsg(ctx context.Context, w dns.ResponseWriter, r, m *dns.Msg, domain string, queryTime time.Time) {
+	span := startSpan(ctx, "write")
+	if err := w.WriteMsg(m); err != nil {
+		tagSpan(span, domain, "write failed")
+	} else {
+		tagSpan(span, domain, "written")
+	}
+	span.Finish()
+	if p.Tap != nil {
+		p.Tap.tap(w, r, queryTime, m)
+	}
+}
+
+// resolution is the outcome of a single question.
+type resolution struct {
+	// domain the question belongs to, nil if it belongs to none
+	domain *domainConfig
+	// zone is the name of the domain or of the alias the question uses for it
+	zone   string
+	opts   domainOptions
+	answer []dns.RR
+	// extra are the records of the additional section
+	extra []dns.RR
+	// exists reports whether the name exists, even if there is no answer for the type
+	exists bool
+	// types are the record types of the name, they are listed in the NSEC of a signed negative answer
+	types []uint16
+	// ip is the address embedded in the name if the answer was built from it
+	ip net.IP
+}
+
+// resolve answers a single question from the static records, the updated records or the address embedded in the
+// name, as seen by the clients of view v (nil for clients without a view).
+func (p *ipecho) resolve(ctx context.Context, w dns.ResponseWriter, question *dns.Question, v *view) resolution {
 	if p.Config.Debug {
 		log.Printf("[ipecho] Query for '%s'", question.Name)
 	}
 
-	for _, domain := range p.Config.Domains {
-		if !strings.HasSuffix(strings.ToLower(question.Name), domain) {
-			continue
+	domain, alias, subdomain := p.matchDomain(ctx, question.Name)
+	if domain == nil {
+		return resolution{}
+	}
+	res := resolution{domain: domain, zone: domain.Name, opts: p.Config.viewOptions(domain, v)}
+	if alias != nil {
+		res.zone = alias.Name
+		if alias.Mode != aliasDecode && subdomain != "" {
+			return p.redirect(ctx, w, question, v, res, alias, subdomain)
 		}
-		subdomain := question.Name[:len(question.Name)-len(domain)]
-		if subdomain == "" {
-			if p.Config.Debug {
-				log.Printf("[ipecho] Query ('%s') has no subomain\n", question.Name)
-			}
-			return nil
+		if alias.Mode == aliasDNAME && question.Qtype == dns.TypeDNAME {
+			res.exists = true
+			res.answer = []dns.RR{dname(alias, res.opts.TTL)}
+			return res
+		}
+	}
+	// with fallthrough the SOA and NS of the zone are left to the next plugin, e.g. file
+	if subdomain == "" && !p.Config.Fall.Through(question.Name) {
+		res.types = append(res.types, dns.TypeSOA, dns.TypeNS)
+		switch {
+		case question.Qtype == dns.TypeSOA:
+			res.exists = true
+			res.answer = []dns.RR{p.Config.soa(res.zone, &res.opts)}
+			return res
+		case question.Qtype == dns.TypeNS && !hasType(domain.Records[domain.Name], dns.TypeNS):
+			res.exists = true
+			res.answer = p.Config.nameservers(res.zone, res.opts.TTL)
+			return res
+		}
+	}
+	if subdomain == "" && alias == nil && domain.Keys != nil {
+		res.types = append(res.types, domain.Keys.types()...)
+		if answer := domain.Keys.apex(question.Qtype, res.opts.TTL); len(answer) > 0 {
+			res.exists = true
+			res.answer = answer
+			return res
+		}
+	}
+	// name is the query name under the domain, the static records are kept by it
+	name := strings.ToLower(subdomain) + domain.Name
+	if txt := p.Config.ACME.records(question.Name); len(txt) > 0 {
+		res.exists = true
+		res.types = append(res.types, dns.TypeTXT)
+		if question.Qtype == dns.TypeTXT {
+			res.answer = txt
+		}
+		return res
+	}
+	records, templates := domain.Records, domain.Templates
+	if _, ok := records[name]; !ok {
+		if dynamic := p.Dynamic.domain(domain.Name); dynamic[name] != nil {
+			records = dynamic
+		}
+	}
+	if vd := v.domain(domain); vd != nil {
+		if _, ok := vd.Records[name]; ok {
+			records = vd.Records
+		}
+		if len(vd.Templates) > 0 {
+			templates = vd.Templates
+		}
+	}
+
+	if _, ok := records[name]; ok {
+		if p.Config.Debug {
+			log.Printf("[ipecho] Answering '%s' from static records\n", question.Name)
 		}
-		subdomain = strings.Trim(subdomain, ".")
+		res.exists = true
+		res.types = append(res.types, records.types(name)...)
+		res.answer = records.answer(name, question.Name, question.Qtype, res.opts.TTL)
 		if subdomain == "" {
-			if p.Config.Debug {
-				log.Printf("[ipecho] Parsed Subdomain of '%s' is empty\n", question.Name)
-			}
-			return nil
+			return p.guard(question, res, records.types(name))
+		}
+		return res
+	}
+	if res.opts.Safeguards != nil && res.opts.dmarcOwner(subdomain) {
+		res.exists = true
+		res.types = append(res.types, dns.TypeTXT)
+		if question.Qtype == dns.TypeTXT {
+			res.answer = []dns.RR{dmarc(question.Name, res.opts.TTL)}
 		}
+		return res
+	}
+	res.exists = subdomain == ""
+
+	ip, port, label := p.decodeIP(ctx, question.Name, domain, &res.opts, subdomain)
+	if ip == nil && len(res.opts.Default) > 0 {
+		res = p.defaultAnswer(question, res)
+		return p.guard(question, res, res.types)
+	}
+	if ip != nil && !p.evaluatePolicy(ctx, question.Name, domain, &res.opts, ip) {
+		ip = nil
+	}
+	if ip == nil {
 		if p.Config.Debug {
-			log.Printf("[ipecho] Parsed Subdomain of '%s' is '%s'\n", question.Name, subdomain)
+			log.Printf("[ipecho] Parsed IP of '%s' is nil\n", question.Name)
 		}
-		return net.ParseIP(subdomain)
+		if subdomain == "" {
+			return p.guard(question, res, nil)
+		}
+		// empty non-terminals exist (RFC 8020)
+		res.exists = res.opts.nonTerminal(strings.Trim(subdomain, ".")) || p.namesBelow(domain, v, name) ||
+			p.Config.ACME.below(question.Name)
+		return res
+	}
+	res.exists = true
+	answerIP := translate(res.opts.NAT, ip)
+	res.types = append(res.types, addressType(answerIP), dns.TypeHTTPS, dns.TypeSVCB)
+	// target is the name of the address without the port, SRV and SVCB records of port-bearing names point to it
+	target := "."
+	if port != 0 {
+		target = label + "." + res.zone
+		res.types = append(res.types, dns.TypeSRV)
+	}
+	if res.opts.MX {
+		res.types = append(res.types, dns.TypeMX)
 	}
+	for rrtype := range templates {
+		res.types = append(res.types, rrtype)
+	}
+	res = p.guard(question, res, res.types)
+	if t := templates.find(question.Qtype); t != nil {
+		data := newTemplateData(question.Name, res.zone, strings.TrimSuffix(subdomain, "."), answerIP, clientIP(w))
+		rr, err := t.render(data, res.opts.TTL)
+		if err != nil {
+			log.Printf("[ipecho] Warning: unable to answer '%s': %s\n", question.Name, err)
+			return res
+		}
+		res.answer = []dns.RR{rr}
+	} else if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
+		res.answer = []dns.RR{p.addressRR(question.Name, answerIP, res.opts.TTL)}
+	} else if question.Qtype == dns.TypeHTTPS || question.Qtype == dns.TypeSVCB {
+		if port == 0 {
+			port = res.opts.Port
+		}
+		res.answer = []dns.RR{serviceBinding(question.Name, question.Qtype, answerIP, port, target, &res.opts)}
+		if target != "." {
+			res.extra = []dns.RR{addressRecord(target, answerIP, res.opts.TTL)}
+		}
+	} else if question.Qtype == dns.TypeSRV && port != 0 {
+		res.answer = []dns.RR{serviceRecord(question.Name, target, port, res.opts.TTL)}
+		res.extra = []dns.RR{addressRecord(target, answerIP, res.opts.TTL)}
+	} else if question.Qtype == dns.TypeMX && res.opts.MX {
+		exchange := question.Name
+		if target != "." {
+			exchange = target
+		}
+		res.answer = []dns.RR{mailExchange(question.Name, exchange, res.opts.TTL)}
+		res.extra = []dns.RR{addressRecord(exchange, answerIP, res.opts.TTL)}
+	} else {
+		return res
+	}
+	res.ip = ip
+	p.record(w, res)
+	return res
+}
 
+// record counts an answer built from the address embedded in the name.
+func (p *ipecho) record(w dns.ResponseWriter, res resolution) {
+	if p.Stats != nil && res.ip != nil {
+		p.Stats.record(res.ip, clientIP(w), res.domain.Name)
+	}
+}
+
+// namesBelow reports whether the static or updated records of domain, as seen by the clients of view v, have names
+// below name.
+func (p *ipecho) namesBelow(domain *domainConfig, v *view, name string) bool {
+	if vd := v.domain(domain); vd != nil && vd.Records.below(name) {
+		return true
+	}
+	return domain.Records.below(name) || p.Dynamic.domain(domain.Name).below(name)
+}
+
+// addressType returns the type of the address record for ip.
+func addressType(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+// addressRR returns the A or AAAA record for ip.
+func (p *ipecho) addressRR(name string, ip net.IP, ttl uint32) dns.RR {
+	if p.Config.Debug {
+		if ip.To4() != nil {
+			log.Printf("[ipecho] Parsed IP of '%s' is an IPv4 address\n", name)
+		} else {
+			log.Printf("[ipecho] Parsed IP of '%s' is an IPv6 address\n", name)
+		}
+	}
+	return addressRecord(name, ip, ttl)
+}
+
+// defaultAnswer answers a name without an embedded address with the default addresses of its domain.
+func (p *ipecho) defaultAnswer(question *dns.Question, res resolution) resolution {
 	if p.Config.Debug {
-		log.Printf("[ipecho] Query ('%s') does not end with one of the domains (%s)\n", question.Name, strings.Join(p.Config.Domains, ", "))
+		log.Printf("[ipecho] Answering '%s' with the default addresses\n", question.Name)
+	}
+	res.exists = true
+	for _, ip := range res.opts.Default {
+		res.types = append(res.types, addressType(ip))
+		if (ip.To4() != nil && question.Qtype == dns.TypeA) || (ip.To4() == nil && question.Qtype == dns.TypeAAAA) {
+			res.answer = append(res.answer, p.addressRR(question.Name, ip, res.opts.TTL))
+		}
+	}
+	return res
+}
+
+// matchDomain returns the configured domain qname belongs to, the alias qname uses for it and the part of qname
+// in front of the domain or alias.
+func (p *ipecho) matchDomain(ctx context.Context, qname string) (*domainConfig, *aliasConfig, string) {
+	span := startSpan(ctx, "match")
+	defer span.Finish()
+
+	if domain, alias, subdomain := p.Config.match(qname); domain != nil {
+		tagSpan(span, domain.Name, "matched")
+		return domain, alias, subdomain
+	}
+
+	if p.Config.Debug {
+		log.Printf("[ipecho] Query ('%s') does not end with one of the domains (%s)\n", qname, strings.Join(p.Config.domainNames(), ", "))
+	}
+	tagSpan(span, "", "unmatched")
+	return nil, nil, ""
+}
+
+// decodeIP returns the address embedded in the name, and the port and the label of the address without the port
+// for port-bearing names.
+func (p *ipecho) decodeIP(ctx context.Context, qname string, domain *domainConfig, opts *domainOptions, subdomain string) (net.IP, uint16, string) {
+	span := startSpan(ctx, "decode")
+	defer span.Finish()
+
+	if subdomain == "" {
+		if p.Config.Debug {
+			log.Printf("[ipecho] Query ('%s') has no subomain\n", qname)
+		}
+		tagSpan(span, domain.Name, "no subdomain")
+		return nil, 0, ""
+	}
+	subdomain = strings.Trim(subdomain, ".")
+	if subdomain == "" {
+		if p.Config.Debug {
+			log.Printf("[ipecho] Parsed Subdomain of '%s' is empty\n", qname)
+		}
+		tagSpan(span, domain.Name, "empty subdomain")
+		return nil, 0, ""
+	}
+	if p.Config.Debug {
+		log.Printf("[ipecho] Parsed Subdomain of '%s' is '%s'\n", qname, subdomain)
+	}
+	ip := opts.decode(subdomain)
+	var port uint16
+	var label string
+	if ip == nil {
+		ip, port, label = opts.decodePort(subdomain)
+	}
+	if ip == nil {
+		tagSpan(span, domain.Name, "invalid address")
+		return nil, 0, ""
+	}
+	tagSpan(span, domain.Name, "decoded")
+	return ip, port, label
+}
+
+// evaluatePolicy reports whether the families and networks of the domain allow answering ip.
+func (p *ipecho) evaluatePolicy(ctx context.Context, qname string, domain *domainConfig, opts *domainOptions, ip net.IP) bool {
+	span := startSpan(ctx, "policy")
+	defer span.Finish()
+
+	ok, outcome := opts.answers(ip)
+	if !ok && p.Config.Debug {
+		log.Printf("[ipecho] Parsed IP of '%s' is refused: %s\n", qname, outcome)
+	}
+	tagSpan(span, domain.Name, outcome)
+	return ok
+}
+
+// clientIP returns the address of the client without the port.
+func clientIP(w dns.ResponseWriter) string {
+	if w.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return w.RemoteAddr().String()
 	}
-	return nil
+	return host
 }
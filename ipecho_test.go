@@ -5,8 +5,11 @@ import (
 	"net"
 	"testing"
 
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
 )
 
 type dummyResponseWriter struct {
@@ -37,14 +40,53 @@ func (d *dummyResponseWriter) ClearMsgs()          { d.msgs = nil }
 func (d *dummyResponseWriter) GetBytes() []byte { return d.bytes }
 func (d *dummyResponseWriter) ClearBytes()      { d.bytes = nil }
 
+// newTestPlugin returns the plugin configured with the Corefile block.
+func newTestPlugin(t *testing.T, block string) ipecho {
+	t.Helper()
+	cfg, err := newConfigFromDispenser(caddyfile.NewDispenser("", buffer.NewReader([]byte(block))))
+	require.NoError(t, err)
+	return ipecho{Config: cfg}
+}
+
+// query asks p for name and returns the reply.
+func query(t *testing.T, p ipecho, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	return queryFrom(t, p, &dummyResponseWriter{}, name, qtype)
+}
+
+// queryFrom asks p for name through w and returns the reply.
+func queryFrom(t *testing.T, p ipecho, w *dummyResponseWriter, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	p.ServeDNS(context.Background(), w, r)
+	require.Equal(t, 1, len(w.GetMsgs()))
+	return w.GetMsgs()[0]
+}
+
+// answers asks p for name and returns the answer in zone file format.
+func answers(t *testing.T, p ipecho, name string, qtype uint16) []string {
+	t.Helper()
+	return rrStrings(query(t, p, name, qtype).Answer)
+}
+
+// rrStrings returns rrs in zone file format.
+func rrStrings(rrs []dns.RR) []string {
+	var s []string
+	for _, rr := range rrs {
+		s = append(s, rr.String())
+	}
+	return s
+}
+
 func TestServeDNS(t *testing.T) {
 	p := ipecho{
 		Config: &config{
-			Domains: []string{
-				"example1.com.",
+			Domains: []*domainConfig{
+				{Name: "example1.com."},
 			},
-			TTL:   60,
-			Debug: true,
+			domainOptions: domainOptions{TTL: 60},
+			Debug:         true,
 		},
 	}
 
@@ -141,7 +183,13 @@ func TestServeDNS(t *testing.T) {
 				},
 			},
 		})
-		require.Equal(t, 0, len(d.GetMsgs()))
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeNameError, d.GetMsgs()[0].Rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, 1, len(d.GetMsgs()[0].Ns))
+		require.Equal(t, "example1.com.", d.GetMsgs()[0].Ns[0].Header().Name)
+		require.Equal(t, dns.Type(dns.TypeSOA), dns.Type(d.GetMsgs()[0].Ns[0].Header().Rrtype))
 	})
 
 	t.Run("No Subdomain", func(t *testing.T) {
@@ -155,7 +203,13 @@ func TestServeDNS(t *testing.T) {
 				},
 			},
 		})
-		require.Equal(t, 0, len(d.GetMsgs()))
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeSuccess, d.GetMsgs()[0].Rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, 1, len(d.GetMsgs()[0].Ns))
+		require.Equal(t, "example1.com.", d.GetMsgs()[0].Ns[0].Header().Name)
+		require.Equal(t, dns.Type(dns.TypeSOA), dns.Type(d.GetMsgs()[0].Ns[0].Header().Rrtype))
 	})
 
 	t.Run("Empty Subdomain", func(t *testing.T) {
@@ -169,7 +223,13 @@ func TestServeDNS(t *testing.T) {
 				},
 			},
 		})
-		require.Equal(t, 0, len(d.GetMsgs()))
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeNameError, d.GetMsgs()[0].Rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, 1, len(d.GetMsgs()[0].Ns))
+		require.Equal(t, "example1.com.", d.GetMsgs()[0].Ns[0].Header().Name)
+		require.Equal(t, dns.Type(dns.TypeSOA), dns.Type(d.GetMsgs()[0].Ns[0].Header().Rrtype))
 	})
 
 	t.Run("Unknown Domain", func(t *testing.T) {
@@ -234,3 +294,318 @@ func TestServeDNS(t *testing.T) {
 		require.Equal(t, net.ParseIP("::1"), d.GetMsgs()[0].Answer[1].(*dns.AAAA).AAAA)
 	})
 }
+
+func TestServeDNSDomainOptions(t *testing.T) {
+	p := ipecho{
+		Config: &config{
+			Domains: []*domainConfig{
+				{
+					Name: "example1.com.",
+					domainOptions: domainOptions{
+						TTL:      30,
+						Formats:  formatDash,
+						Families: familyV4,
+						Deny:     []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}},
+					},
+					set: optionTTL | optionFormats | optionFamilies | optionDeny,
+				},
+				{
+					Name: "example2.com.",
+				},
+			},
+			domainOptions: domainOptions{
+				TTL:     60,
+				Formats: formatDotted | formatDash,
+			},
+		},
+	}
+
+	query := func(name string, qtype uint16) []dns.RR {
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: qtype}},
+		})
+		if len(d.GetMsgs()) == 0 {
+			return nil
+		}
+		return d.GetMsgs()[0].Answer
+	}
+
+	t.Run("Dash", func(t *testing.T) {
+		rrs := query("app.127-0-0-1.example1.com.", dns.TypeA)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, net.ParseIP("127.0.0.1"), rrs[0].(*dns.A).A)
+		require.Equal(t, uint32(30), rrs[0].Header().Ttl)
+
+		rrs = query("2001-db8--1.example2.com.", dns.TypeAAAA)
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, net.ParseIP("2001:db8::1"), rrs[0].(*dns.AAAA).AAAA)
+		require.Equal(t, uint32(60), rrs[0].Header().Ttl)
+	})
+
+	t.Run("Dotted Not Enabled", func(t *testing.T) {
+		require.Empty(t, query("127.0.0.1.example1.com.", dns.TypeA))
+		require.Equal(t, 1, len(query("127.0.0.1.example2.com.", dns.TypeA)))
+	})
+
+	t.Run("Family Not Enabled", func(t *testing.T) {
+		require.Empty(t, query("2001-db8--1.example1.com.", dns.TypeAAAA))
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		require.Empty(t, query("10-1-2-3.example1.com.", dns.TypeA))
+		require.Equal(t, 1, len(query("10-1-2-3.example2.com.", dns.TypeA)))
+	})
+}
+
+func TestServeDNSRootDomain(t *testing.T) {
+	p := ipecho{
+		Config: &config{
+			Domains:       []*domainConfig{{Name: "."}},
+			domainOptions: domainOptions{TTL: 60},
+		},
+	}
+	d := &dummyResponseWriter{}
+	p.ServeDNS(context.Background(), d, &dns.Msg{
+		Question: []dns.Question{{Name: "127.0.0.1.", Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+	})
+	require.Equal(t, 1, len(d.GetMsgs()))
+	require.Equal(t, net.ParseIP("127.0.0.1"), d.GetMsgs()[0].Answer[0].(*dns.A).A)
+
+	for _, question := range []dns.Question{
+		{Name: ".", Qclass: dns.ClassINET, Qtype: dns.TypeSOA},
+		{Name: ".", Qclass: dns.ClassINET, Qtype: dns.TypeNS},
+		{Name: "test.", Qclass: dns.ClassINET, Qtype: dns.TypeA},
+	} {
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{Question: []dns.Question{question}})
+		require.Equal(t, 1, len(d.GetMsgs()))
+		_, err := d.GetMsgs()[0].Pack()
+		require.NoError(t, err, question.String())
+	}
+	soa := p.Config.soa(".", &p.Config.domainOptions)
+	require.Equal(t, "ns1.", soa.Ns)
+	require.Equal(t, "hostmaster.", soa.Mbox)
+	require.Equal(t, "ns1.", p.Config.nameservers(".", 60)[0].(*dns.NS).Ns)
+}
+
+func TestServeDNSNameservers(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example1.com
+			nameservers NS.example.net. ns2
+			hostmaster dns.admin@example.net
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+
+	soa := cfg.soa("example1.com.", &cfg.domainOptions)
+	require.Equal(t, "ns.example.net.", soa.Ns)
+	require.Equal(t, "dns\\.admin.example.net.", soa.Mbox)
+	var ns []string
+	for _, rr := range cfg.nameservers("example1.com.", 60) {
+		ns = append(ns, rr.(*dns.NS).Ns)
+	}
+	require.Equal(t, []string{"ns.example.net.", "ns2.example1.com."}, ns)
+
+	require.NoError(t, parseHostmasterPart([]string{"admin"}, cfg))
+	require.Equal(t, "admin.example1.com.", cfg.soa("example1.com.", &cfg.domainOptions).Mbox)
+
+	for _, line := range []string{"nameservers", "nameservers .", "nameservers a..b", "hostmaster", "hostmaster a b", "hostmaster @"} {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte("{\ndomain example1.com\n"+line+"\n}")))
+		_, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err, line)
+	}
+}
+
+func TestServeDNSSharedSuffix(t *testing.T) {
+	next := false
+	p := ipecho{
+		Next: plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+			next = true
+			return dns.RcodeSuccess, nil
+		}),
+		Config: &config{
+			Domains:       []*domainConfig{{Name: "example.com."}},
+			domainOptions: domainOptions{TTL: 60},
+		},
+	}
+	for _, name := range []string{"notexample.com.", "10.0.0.1.notexample.com."} {
+		next = false
+		d := &dummyResponseWriter{}
+		_, err := p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 0, len(d.GetMsgs()), name)
+		require.True(t, next, name)
+	}
+}
+
+func TestServeDNSEmptyNonTerminals(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example1.com {
+				record www.lab A 192.0.2.1
+			}
+			domain example2.com {
+				formats dash
+			}
+			ttl 60
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	p := ipecho{Config: cfg}
+
+	query := func(name string) *dns.Msg {
+		w := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), w, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0]
+	}
+
+	for _, name := range []string{
+		"1.example1.com.",
+		"0.1.example1.com.",
+		"0.0.1.example1.com.",
+		"lab.example1.com.",
+		"p8443.example1.com.",
+		"1.p8443.example1.com.",
+		"0.0.1.p8443.example1.com.",
+	} {
+		m := query(name)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode, name)
+		require.Empty(t, m.Answer, name)
+		require.Equal(t, 1, len(m.Ns), name)
+		require.Equal(t, dns.Type(dns.TypeSOA), dns.Type(m.Ns[0].Header().Rrtype), name)
+	}
+	for _, name := range []string{
+		"256.example1.com.",
+		"test.example1.com.",
+		"x.lab.example1.com.",
+		"p0.example1.com.",
+		"0.0.0.0.1.example1.com.",
+		"1.example2.com.",
+		"p8443.example2.com.",
+	} {
+		require.Equal(t, dns.RcodeNameError, query(name).Rcode, name)
+	}
+}
+
+func TestServeDNSFallthrough(t *testing.T) {
+	cfg := &config{
+		Domains: []*domainConfig{
+			{Name: "example1.com."},
+			{Name: "example2.com."},
+		},
+		domainOptions: domainOptions{TTL: 60},
+	}
+	cfg.Fall.SetZonesFromArgs([]string{"example2.com"})
+	p := ipecho{Config: cfg}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: qtype}},
+		})
+		if len(d.GetMsgs()) == 0 {
+			return nil
+		}
+		return d.GetMsgs()[0]
+	}
+
+	t.Run("Not In Fallthrough Zones", func(t *testing.T) {
+		m := query("test.example1.com.", dns.TypeA)
+		require.NotNil(t, m)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+	})
+
+	t.Run("In Fallthrough Zones", func(t *testing.T) {
+		require.Nil(t, query("test.example2.com.", dns.TypeA))
+		require.Nil(t, query("example2.com.", dns.TypeA))
+		require.Nil(t, query("example2.com.", dns.TypeSOA), "the next plugin serves the SOA of the zone")
+		require.Nil(t, query("example2.com.", dns.TypeNS))
+		require.NotNil(t, query("127.0.0.1.example2.com.", dns.TypeA))
+		require.Equal(t, 1, len(query("example1.com.", dns.TypeSOA).Answer))
+	})
+
+	t.Run("Other Type For Existing Name", func(t *testing.T) {
+		m := query("127.0.0.1.example1.com.", dns.TypeMX)
+		require.NotNil(t, m)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Empty(t, m.Answer)
+		require.Equal(t, 1, len(m.Ns))
+	})
+
+	t.Run("Fallthrough All Zones", func(t *testing.T) {
+		cfg := &config{
+			Domains:       []*domainConfig{{Name: "example1.com."}},
+			domainOptions: domainOptions{TTL: 60},
+		}
+		cfg.Fall.SetZonesFromArgs(nil)
+		p := ipecho{Config: cfg}
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: "test.example1.com.", Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+		require.Equal(t, 0, len(d.GetMsgs()))
+	})
+}
+
+func TestServeDNSDefault(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example1.com {
+				default 127.0.0.1 ::1
+				deny 10.0.0.0/8
+				record www A 192.0.2.1
+			}
+			domain example2.com
+			ttl 60
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1", "::1"}, cfg.Domains[0].spec().Default)
+	p := ipecho{Config: cfg}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		w := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), w, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: qtype}},
+		})
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0]
+	}
+
+	m := query("anything.localhost.example1.com.", dns.TypeA)
+	require.Equal(t, 1, len(m.Answer))
+	require.Equal(t, net.ParseIP("127.0.0.1").To4(), m.Answer[0].(*dns.A).A.To4())
+
+	m = query("example1.com.", dns.TypeAAAA)
+	require.Equal(t, 1, len(m.Answer))
+	require.Equal(t, net.ParseIP("::1"), m.Answer[0].(*dns.AAAA).AAAA)
+
+	m = query("anything.example1.com.", dns.TypeTXT)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode)
+	require.Empty(t, m.Answer)
+
+	// embedded addresses and static records take precedence, refused addresses are not replaced
+	m = query("192.0.2.9.example1.com.", dns.TypeA)
+	require.Equal(t, net.ParseIP("192.0.2.9").To4(), m.Answer[0].(*dns.A).A.To4())
+	m = query("www.example1.com.", dns.TypeA)
+	require.Equal(t, net.ParseIP("192.0.2.1").To4(), m.Answer[0].(*dns.A).A.To4())
+	m = query("10.0.0.1.example1.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, m.Rcode)
+
+	m = query("anything.example2.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, m.Rcode)
+
+	dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte("{\ndomain example1.com {\ndefault localhost\n}\n}")))
+	_, err = newConfigFromDispenser(dispenser)
+	require.Error(t, err)
+}
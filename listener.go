@@ -0,0 +1,63 @@
+package ipecho
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpListener serves an HTTP API of the plugin, the statistics, the admin API or the acme API.
+// It can be stopped and started again, as a reload needs it.
+type httpListener struct {
+	// name is used in errors and logs
+	name    string
+	addr    string
+	handler http.Handler
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func newHTTPListener(name, addr string, handler http.Handler) *httpListener {
+	return &httpListener{name: name, addr: addr, handler: handler}
+}
+
+func (l *httpListener) start() error {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return fmt.Errorf("unable to start %s: %w", l.name, err)
+	}
+	//nolint: gomnd // a slow client must not keep the listener busy
+	server := &http.Server{Handler: l.handler, ReadHeaderTimeout: 5 * time.Second}
+	l.listener, l.server = ln, server
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[ipecho] Listener of the %s failed: %v\n", l.name, err)
+		}
+	}()
+	return nil
+}
+
+func (l *httpListener) stop() error {
+	if l.server == nil {
+		return nil
+	}
+	err := l.server.Close()
+	// Serve closes the listener only once it runs, a reload has to be able to listen on the address right away
+	_ = l.listener.Close()
+	l.listener, l.server = nil, nil
+	return err
+}
+
+// writeJSON writes v as the JSON body of a response with status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ipecho] Unable to write response: %v\n", err)
+	}
+}
@@ -0,0 +1,36 @@
+package ipecho
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPListenerReload(t *testing.T) {
+	addr := freeAddr(t)
+	old := newHTTPListener("test API", addr, http.NotFoundHandler())
+	require.NoError(t, old.start())
+
+	// a reload stops the listener of the old instance before the new instance starts
+	require.NoError(t, old.stop())
+	reloaded := newHTTPListener("test API", addr, http.NotFoundHandler())
+	require.NoError(t, reloaded.start())
+	require.Error(t, old.start(), "the address is in use")
+	require.NoError(t, reloaded.stop())
+
+	// a failed reload starts it again
+	require.NoError(t, old.start())
+	require.NoError(t, old.stop())
+	require.NoError(t, old.stop())
+}
+
+// freeAddr returns a local address no one listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	return addr
+}
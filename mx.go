@@ -0,0 +1,36 @@
+package ipecho
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// mxPreference is the preference of the synthesized MX records.
+const mxPreference = 10
+
+// parseMXOption parses "mx on" or "mx off".
+func parseMXOption(args []string, opts *domainOptions) (option, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("mx takes either on or off")
+	}
+	switch strings.ToLower(args[0]) {
+	case "on":
+		opts.MX = true
+	case "off":
+		opts.MX = false
+	default:
+		return 0, fmt.Errorf("mx takes either on or off, not '%s'", args[0])
+	}
+	return optionMX, nil
+}
+
+// mailExchange returns the MX record of a name with an embedded address, exchange is the name of the address.
+func mailExchange(qname, exchange string, ttl uint32) dns.RR {
+	return &dns.MX{
+		Hdr:        dns.RR_Header{Name: qname, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: ttl},
+		Preference: mxPreference,
+		Mx:         exchange,
+	}
+}
@@ -0,0 +1,38 @@
+package ipecho
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailExchange(t *testing.T) {
+	p := newTestPlugin(t, `
+		{
+			domain mail.example.com {
+				mx on
+				formats dash
+			}
+			domain example.com
+			safeguards none
+			ttl 60
+		}
+	`)
+
+	m := query(t, p, "10-0-0-1.mail.example.com.", dns.TypeMX)
+	require.Equal(t, []string{"10-0-0-1.mail.example.com.\t60\tIN\tMX\t10 10-0-0-1.mail.example.com."}, rrStrings(m.Answer))
+	require.Equal(t, []string{"10-0-0-1.mail.example.com.\t60\tIN\tA\t10.0.0.1"}, rrStrings(m.Extra))
+
+	m = query(t, p, "2001-db8--1-p2525.mail.example.com.", dns.TypeMX)
+	require.Equal(t, []string{"2001-db8--1-p2525.mail.example.com.\t60\tIN\tMX\t10 2001-db8--1.mail.example.com."}, rrStrings(m.Answer))
+	require.Equal(t, []string{"2001-db8--1.mail.example.com.\t60\tIN\tAAAA\t2001:db8::1"}, rrStrings(m.Extra))
+
+	m = query(t, p, "10.0.0.1.example.com.", dns.TypeMX)
+	require.Equal(t, []string{"10.0.0.1.example.com.\t60\tIN\tMX\t0 ."}, rrStrings(m.Answer), "mx is opt-in")
+	require.Empty(t, m.Extra)
+
+	require.Equal(t, true, *p.Config.findDomain("mail.example.com.").spec().MX)
+	_, err := parseMXOption([]string{"yes"}, &domainOptions{})
+	require.Error(t, err)
+}
@@ -0,0 +1,59 @@
+package ipecho
+
+import (
+	"fmt"
+	"net"
+)
+
+// natMapping translates the addresses of one network to the same host part in another network of the same size.
+type natMapping struct {
+	From *net.IPNet
+	To   *net.IPNet
+}
+
+// parseNATMapping parses the networks from and to, a bare address is a single host.
+func parseNATMapping(from, to string) (natMapping, error) {
+	networks, err := parseNetworks([]string{from, to})
+	if err != nil {
+		return natMapping{}, err
+	}
+	m := natMapping{From: networks[0], To: networks[1]}
+	fromOnes, fromBits := m.From.Mask.Size()
+	toOnes, toBits := m.To.Mask.Size()
+	if fromOnes != toOnes || fromBits != toBits {
+		return natMapping{}, fmt.Errorf("nat networks '%s' and '%s' differ in size", m.From, m.To)
+	}
+	return m, nil
+}
+
+func (m natMapping) String() string {
+	return m.From.String() + " " + m.To.String()
+}
+
+// translate returns ip translated by the first mapping that contains it, or ip itself if none does.
+func translate(mappings []natMapping, ip net.IP) net.IP {
+	for _, m := range mappings {
+		if !m.From.Contains(ip) {
+			continue
+		}
+		addr := ip.To4()
+		if len(m.From.IP) == net.IPv6len {
+			addr = ip.To16()
+		}
+		translated := make(net.IP, len(addr))
+		for i := range addr {
+			translated[i] = m.To.IP[i] | addr[i]&^m.To.Mask[i]
+		}
+		return translated
+	}
+	return ip
+}
+
+// natStrings returns the mappings as they are written in the Corefile.
+func natStrings(mappings []natMapping) []string {
+	s := make([]string, 0, len(mappings))
+	for _, m := range mappings {
+		s = append(s, m.String())
+	}
+	return s
+}
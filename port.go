@@ -0,0 +1,88 @@
+package ipecho
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// decodePort returns the address and the port embedded in subdomain, e.g. 10-0-0-1-p8080 with the dash format or
+// 10.0.0.1.p8443 with the dotted format, and the label of the address without the port. Service labels in front
+// of the address, as in _http._tcp.10.0.0.1.p8443, are skipped. subdomain has no trailing dot.
+func (opts *domainOptions) decodePort(subdomain string) (net.IP, uint16, string) {
+	subdomain = strings.ToLower(subdomain)
+	if opts.Formats&formatDotted != 0 {
+		if i := strings.LastIndexByte(subdomain, '.'); i >= 0 {
+			if port, ok := portLabel(subdomain[i+1:]); ok {
+				address := subdomain[:i]
+				for strings.HasPrefix(address, "_") && strings.IndexByte(address, '.') > 0 {
+					address = address[strings.IndexByte(address, '.')+1:]
+				}
+				if ip := net.ParseIP(address); ip != nil {
+					return ip, port, address
+				}
+			}
+		}
+	}
+	if opts.Formats&formatDash != 0 {
+		dot := strings.LastIndexByte(subdomain, '.')
+		label := subdomain[dot+1:]
+		if i := strings.LastIndex(label, "-p"); i > 0 && (dot < 0 || serviceLabels(subdomain[:dot])) {
+			if port, ok := portLabel(label[i+1:]); ok {
+				if ip := decodeDash(label[:i]); ip != nil {
+					return ip, port, label[:i]
+				}
+			}
+		}
+	}
+	return nil, 0, ""
+}
+
+// serviceLabels reports whether every label of s is a service label, e.g. _http._tcp.
+func serviceLabels(s string) bool {
+	for _, label := range strings.Split(s, ".") {
+		if !strings.HasPrefix(label, "_") {
+			return false
+		}
+	}
+	return true
+}
+
+// nonTerminal reports whether subdomain, without the trailing dot, is an empty non-terminal above names with an
+// embedded address: the trailing labels of a dotted IPv4 address, e.g. 0.1 of 10.0.0.1, and a port label, e.g.
+// p8443 or 0.1.p8443 of 10.0.0.1.p8443. Allow and deny networks are not taken into account.
+func (opts *domainOptions) nonTerminal(subdomain string) bool {
+	if opts.Formats&formatDotted == 0 {
+		return false
+	}
+	labels := strings.Split(strings.ToLower(subdomain), ".")
+	if _, ok := portLabel(labels[len(labels)-1]); ok {
+		labels = labels[:len(labels)-1]
+		if len(labels) == 0 {
+			return opts.Families != 0
+		}
+	}
+	if len(labels) >= net.IPv4len || opts.Families&familyV4 == 0 {
+		return false
+	}
+	return net.ParseIP(strings.Repeat("0.", net.IPv4len-len(labels))+strings.Join(labels, ".")) != nil
+}
+
+// portLabel parses a port label, e.g. p8080.
+func portLabel(label string) (uint16, bool) {
+	if !strings.HasPrefix(label, "p") {
+		return 0, false
+	}
+	port, err := parsePort(label[1:])
+	return port, err == nil
+}
+
+// serviceRecord returns the SRV record of a port-bearing name that points to target, the name of the address.
+func serviceRecord(qname, target string, port uint16, ttl uint32) dns.RR {
+	return &dns.SRV{
+		Hdr:    dns.RR_Header{Name: qname, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+		Port:   port,
+		Target: target,
+	}
+}
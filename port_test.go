@@ -0,0 +1,47 @@
+package ipecho
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortNames(t *testing.T) {
+	p := newTestPlugin(t, `
+		{
+			domain example.com {
+				formats dotted dash
+				alpn h2
+			}
+			domain example2.com {
+				formats dotted
+			}
+			ttl 60
+		}
+	`)
+
+	m := query(t, p, "_http._tcp.10-0-0-1-p8080.example.com.", dns.TypeSRV)
+	require.Equal(t, []string{"_http._tcp.10-0-0-1-p8080.example.com.\t60\tIN\tSRV\t0 0 8080 10-0-0-1.example.com."}, rrStrings(m.Answer))
+	require.Equal(t, []string{"10-0-0-1.example.com.\t60\tIN\tA\t10.0.0.1"}, rrStrings(m.Extra))
+
+	m = query(t, p, "_https._tcp.10.0.0.1.p8443.example.com.", dns.TypeSRV)
+	require.Equal(t, []string{"_https._tcp.10.0.0.1.p8443.example.com.\t60\tIN\tSRV\t0 0 8443 10.0.0.1.example.com."}, rrStrings(m.Answer))
+	require.Equal(t, []string{"10.0.0.1.example.com.\t60\tIN\tA\t10.0.0.1"}, rrStrings(m.Extra))
+
+	m = query(t, p, "2001-db8--1-p8443.example.com.", dns.TypeSVCB)
+	require.Equal(t, []string{"2001-db8--1-p8443.example.com.\t60\tIN\tSVCB\t1 2001-db8--1.example.com. alpn=\"h2\" port=\"8443\" ipv6hint=\"2001:db8::1\""}, rrStrings(m.Answer))
+	require.Equal(t, []string{"2001-db8--1.example.com.\t60\tIN\tAAAA\t2001:db8::1"}, rrStrings(m.Extra))
+
+	m = query(t, p, "10.0.0.1.p8443.example.com.", dns.TypeA)
+	require.Equal(t, []string{"10.0.0.1.p8443.example.com.\t60\tIN\tA\t10.0.0.1"}, rrStrings(m.Answer), "port-bearing names have the address")
+	require.Empty(t, m.Extra)
+
+	m = query(t, p, "10.0.0.1.example.com.", dns.TypeSRV)
+	require.Empty(t, m.Answer, "no SRV without a port")
+	require.Equal(t, dns.RcodeNameError, query(t, p, "10-0-0-1-p8080.example2.com.", dns.TypeSRV).Rcode, "dash format is disabled")
+	require.Equal(t, dns.RcodeNameError, query(t, p, "10.0.0.1.p0.example.com.", dns.TypeSRV).Rcode)
+	require.Equal(t, dns.RcodeNameError, query(t, p, "foo.bar.10-0-0-1-p8080.example.com.", dns.TypeSRV).Rcode, "only service labels in front")
+	require.Equal(t, dns.RcodeNameError, query(t, p, "_http.foo.10-0-0-1-p8080.example.com.", dns.TypeA).Rcode)
+	require.Equal(t, dns.RcodeNameError, query(t, p, "10.0.0.1.p65536.example.com.", dns.TypeSRV).Rcode)
+}
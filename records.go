@@ -0,0 +1,180 @@
+package ipecho
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// inheritTTL marks a static record without an explicit TTL, it is answered with the TTL of its domain.
+const inheritTTL = math.MaxUint32
+
+// staticRecords are records for specific names of a domain, keyed by the lower cased owner name.
+// They take precedence over the address embedded in the name.
+type staticRecords map[string][]dns.RR
+
+// add adds rr, it reports an error if the owner of rr is not part of domain.
+func (s staticRecords) add(domain string, rr dns.RR) error {
+	owner := strings.ToLower(rr.Header().Name)
+	if !dns.IsSubDomain(domain, owner) {
+		return fmt.Errorf("'%s' is not part of domain '%s'", rr.Header().Name, domain)
+	}
+	rr.Header().Name = owner
+	s[owner] = append(s[owner], rr)
+	return nil
+}
+
+// parseRecord parses a record in zone file syntax, names are relative to domain ("@" is the domain itself).
+func parseRecord(domain, line string) (dns.RR, error) {
+	zp := dns.NewZoneParser(strings.NewReader(line), domain, "")
+	zp.SetDefaultTTL(inheritTTL)
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("invalid record '%s': %w", line, err)
+	}
+	if !ok || rr == nil {
+		return nil, fmt.Errorf("invalid record '%s'", line)
+	}
+	if _, more := zp.Next(); more {
+		return nil, fmt.Errorf("invalid record '%s': only one record per line is allowed", line)
+	}
+	return rr, nil
+}
+
+// recordLine joins the arguments of a record directive, the Corefile lexer already removed the quotes.
+func recordLine(args []string) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t;\"") {
+			arg = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// readHostsFile reads A and AAAA records of domain from a file in hosts format.
+// Names that are not fully qualified are relative to domain, names outside of domain are reported as error.
+func readHostsFile(domain, path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: invalid hosts entry", path, lineNumber)
+		}
+		for _, name := range fields[1:] {
+			owner := dns.Fqdn(name)
+			if !strings.HasSuffix(name, ".") && !dns.IsSubDomain(domain, owner) {
+				owner = dns.Fqdn(name + "." + strings.TrimSuffix(domain, "."))
+			}
+			hdr := dns.RR_Header{Name: owner, Class: dns.ClassINET, Ttl: inheritTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// loadRecords parses the record lines and the hosts file of d into d.Records.
+func (d *domainConfig) loadRecords() error {
+	d.Records = staticRecords{}
+	for _, line := range d.RecordLines {
+		rr, err := parseRecord(d.Name, line)
+		if err != nil {
+			return err
+		}
+		if err := d.Records.add(d.Name, rr); err != nil {
+			return err
+		}
+	}
+	if d.Hosts != "" {
+		rrs, err := readHostsFile(d.Name, d.Hosts)
+		if err != nil {
+			return fmt.Errorf("unable to read hosts file: %w", err)
+		}
+		for _, rr := range rrs {
+			if err := d.Records.add(d.Name, rr); err != nil {
+				return fmt.Errorf("%s: %w", d.Hosts, err)
+			}
+		}
+	}
+	return nil
+}
+
+// answer returns the records of name with type qtype, or the CNAME of name if there are none.
+// The records are copies with the owner name qname and the TTL of the domain if they have none.
+func (s staticRecords) answer(name, qname string, qtype uint16, ttl uint32) []dns.RR {
+	records := s[strings.ToLower(name)]
+	var rrs []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, staticCopy(rr, qname, ttl))
+		}
+	}
+	if len(rrs) > 0 {
+		return rrs
+	}
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			return []dns.RR{staticCopy(rr, qname, ttl)}
+		}
+	}
+	return nil
+}
+
+// types returns the record types of name.
+func (s staticRecords) types(name string) []uint16 {
+	types := make([]uint16, 0, len(s[name]))
+	for _, rr := range s[name] {
+		types = append(types, rr.Header().Rrtype)
+	}
+	return types
+}
+
+// below reports whether s has records of names below name, which makes name an empty non-terminal if it has none
+// of its own.
+func (s staticRecords) below(name string) bool {
+	for owner := range s {
+		if owner != name && dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+func staticCopy(rr dns.RR, qname string, ttl uint32) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = qname
+	if rr.Header().Ttl == inheritTTL {
+		rr.Header().Ttl = ttl
+	}
+	return rr
+}
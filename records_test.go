@@ -0,0 +1,125 @@
+package ipecho
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordLine(t *testing.T) {
+	require.Equal(t, `www A 192.0.2.1`, recordLine([]string{"www", "A", "192.0.2.1"}))
+	require.Equal(t, `_dmarc TXT "v=DMARC1; p=reject"`, recordLine([]string{"_dmarc", "TXT", "v=DMARC1; p=reject"}))
+}
+
+func TestParseRecord(t *testing.T) {
+	rr, err := parseRecord("example1.com.", "@ A 192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, "example1.com.", rr.Header().Name)
+	require.Equal(t, uint32(inheritTTL), rr.Header().Ttl)
+
+	rr, err = parseRecord("example1.com.", "mail 60 MX 10 mx.example.net.")
+	require.NoError(t, err)
+	require.Equal(t, "mail.example1.com.", rr.Header().Name)
+	require.Equal(t, uint32(60), rr.Header().Ttl)
+
+	_, err = parseRecord("example1.com.", "www A 192.0.2.256")
+	require.Error(t, err)
+
+	d := &domainConfig{Name: "example1.com.", RecordLines: []string{"www.example2.com. A 192.0.2.1"}}
+	require.Error(t, d.loadRecords())
+}
+
+func TestReadHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte(`
+# static hosts
+192.0.2.1   www www.example1.com   # both are the same name
+2001:db8::1 www
+192.0.2.2   mail.example1.com.
+`), 0o600))
+
+	rrs, err := readHostsFile("example1.com.", path)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(rrs))
+	require.Equal(t, "www.example1.com.", rrs[0].Header().Name)
+	require.Equal(t, "www.example1.com.", rrs[1].Header().Name)
+	require.Equal(t, dns.Type(dns.TypeAAAA), dns.Type(rrs[2].Header().Rrtype))
+	require.Equal(t, "mail.example1.com.", rrs[3].Header().Name)
+
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.1 other.example2.com.\n"), 0o600))
+	d := &domainConfig{Name: "example1.com.", Hosts: path}
+	require.Error(t, d.loadRecords())
+
+	require.NoError(t, os.WriteFile(path, []byte("www\n"), 0o600))
+	_, err = readHostsFile("example1.com.", path)
+	require.Error(t, err)
+}
+
+func TestServeDNSStaticRecords(t *testing.T) {
+	d := &domainConfig{
+		Name: "example1.com.",
+		RecordLines: []string{
+			"@ A 192.0.2.1",
+			"www CNAME example1.com.",
+			"_dmarc 30 TXT \"v=DMARC1; p=reject\"",
+			"127.0.0.2 A 192.0.2.2",
+		},
+	}
+	require.NoError(t, d.loadRecords())
+	p := ipecho{
+		Config: &config{
+			Domains:       []*domainConfig{d},
+			domainOptions: domainOptions{TTL: 60},
+		},
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		w := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), w, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: qtype}},
+		})
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0]
+	}
+
+	t.Run("Apex", func(t *testing.T) {
+		m := query("Example1.com.", dns.TypeA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "Example1.com.", m.Answer[0].Header().Name)
+		require.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+		require.Equal(t, net.ParseIP("192.0.2.1").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("CNAME", func(t *testing.T) {
+		m := query("www.example1.com.", dns.TypeA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "example1.com.", m.Answer[0].(*dns.CNAME).Target)
+	})
+
+	t.Run("TXT", func(t *testing.T) {
+		m := query("_dmarc.example1.com.", dns.TypeTXT)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+		require.Equal(t, []string{"v=DMARC1; p=reject"}, m.Answer[0].(*dns.TXT).Txt)
+	})
+
+	t.Run("No Data", func(t *testing.T) {
+		m := query("_dmarc.example1.com.", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Empty(t, m.Answer)
+	})
+
+	t.Run("Override Takes Precedence", func(t *testing.T) {
+		m := query("127.0.0.2.example1.com.", dns.TypeA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, net.ParseIP("192.0.2.2").To4(), m.Answer[0].(*dns.A).A.To4())
+
+		m = query("127.0.0.3.example1.com.", dns.TypeA)
+		require.Equal(t, net.ParseIP("127.0.0.3").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+}
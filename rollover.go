@@ -0,0 +1,565 @@
+package ipecho
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// keyPropagation is how long a key is published before it signs and stays published after it stopped signing,
+	// it has to cover the TTL of the DNSKEY set (maxKeyTTL) and of the signatures made with the key
+	keyPropagation = 48 * time.Hour
+	// dsPropagation is how long both KSKs sign the DNSKEY set after the CDS changed, the parent has to pick up the
+	// new DS in this time
+	dsPropagation = 7 * 24 * time.Hour
+
+	defaultZSKLifetime = 90 * 24 * time.Hour
+	defaultKSKLifetime = 365 * 24 * time.Hour
+	rolloverInterval   = time.Hour
+	// rolloverAlgorithm is used for the generated keys
+	rolloverAlgorithm = dns.ECDSAP256SHA256
+	rolloverKeyBits   = 256
+	resolvConf        = "/etc/resolv.conf"
+)
+
+// keyState is the timeline of a key that is rolled over.
+type keyState struct {
+	// File is the name of the key files in the state directory, without .key or .private
+	File     string    `json:"file"`
+	Tag      uint16    `json:"tag"`
+	KSK      bool      `json:"ksk"`
+	Publish  time.Time `json:"publish"`
+	Activate time.Time `json:"activate"`
+	Inactive time.Time `json:"inactive"`
+	Delete   time.Time `json:"delete"`
+	// Replaced is when the DS of the parent was seen pointing to the successor of a KSK, a KSK keeps signing
+	// after its inactive time until then
+	Replaced time.Time `json:"replaced,omitempty"`
+}
+
+func (k *keyState) role() string {
+	if k.KSK {
+		return "KSK"
+	}
+	return "ZSK"
+}
+
+func (k *keyState) published(now time.Time) bool {
+	return !now.Before(k.Publish) && (now.Before(k.Delete) || k.held(now))
+}
+
+func (k *keyState) active(now time.Time) bool {
+	return !now.Before(k.Activate) && (now.Before(k.Inactive) || k.held(now))
+}
+
+// held reports whether k is a KSK that is due to be retired at now, but the parent was not seen to replace its DS.
+func (k *keyState) held(now time.Time) bool {
+	return k.KSK && k.Replaced.IsZero() && !now.Before(k.Inactive)
+}
+
+// keyManager generates, publishes and retires the keys of a domain and keeps their timeline in a state directory.
+// ZSKs are rolled over by pre-publication, KSKs by double signature with CDS and CDNSKEY for the parent. An old KSK
+// is only retired once the DS of the parent points to its successor.
+type keyManager struct {
+	zone        string
+	dir         string
+	zskLifetime time.Duration
+	kskLifetime time.Duration
+	signer      *signer
+
+	// resolver is the address of the resolver the DS of the parent is looked up with, empty uses the resolvers of
+	// the system
+	resolver string
+
+	mu    sync.Mutex
+	state []*keyState
+	keys  map[string]*dnssecKey
+	now   func() time.Time
+	// lookupDS returns the DS records the parent has for the zone
+	lookupDS func(zone string) ([]*dns.DS, error)
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// parseLifetime parses a duration that can also be given in days, e.g. 90d.
+func parseLifetime(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseUint(days, 10, 16)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid key lifetime: '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid key lifetime: '%s'", s)
+	}
+	return d, nil
+}
+
+// newKeyManager returns the key manager of zone for the arguments of "dnssec auto",
+// "<dir> [zsk <lifetime>] [ksk <lifetime>] [resolver <address>]". It reads the keys that are already in dir.
+func newKeyManager(zone string, args []string) (*keyManager, error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return nil, fmt.Errorf("dnssec auto takes a state directory, optional key lifetimes and a resolver")
+	}
+	m := &keyManager{
+		zone:        zone,
+		dir:         args[0],
+		zskLifetime: defaultZSKLifetime,
+		kskLifetime: defaultKSKLifetime,
+		signer:      &signer{zone: zone},
+		keys:        map[string]*dnssecKey{},
+		now:         time.Now,
+	}
+	m.lookupDS = func(zone string) ([]*dns.DS, error) { return lookupDS(m.resolver, zone) }
+	for i := 1; i < len(args); i += 2 {
+		if strings.EqualFold(args[i], "resolver") {
+			resolver, err := parseResolver(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m.resolver = resolver
+			continue
+		}
+		lifetime, err := parseLifetime(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(args[i]) {
+		case "zsk":
+			m.zskLifetime = lifetime
+		case "ksk":
+			m.kskLifetime = lifetime
+		default:
+			return nil, fmt.Errorf("unknown key type '%s'", args[i])
+		}
+	}
+	if m.zskLifetime <= 2*keyPropagation {
+		return nil, fmt.Errorf("zsk lifetime has to be longer than %s", 2*keyPropagation)
+	}
+	if m.kskLifetime <= keyPropagation+dsPropagation {
+		return nil, fmt.Errorf("ksk lifetime has to be longer than %s", keyPropagation+dsPropagation)
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.signer.keys.Store(m.keySet(m.now()))
+	return m, nil
+}
+
+// parseResolver parses the address of a resolver, an IP address with an optional port.
+func parseResolver(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid resolver: '%s'", s)
+	}
+	if _, err := parsePort(port); err != nil {
+		return "", fmt.Errorf("invalid resolver: '%s'", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// args returns the arguments of "dnssec auto" for m.
+func (m *keyManager) args() []string {
+	args := []string{"auto", m.dir, "zsk", m.zskLifetime.String(), "ksk", m.kskLifetime.String()}
+	if m.resolver != "" {
+		args = append(args, "resolver", m.resolver)
+	}
+	return args
+}
+
+func (m *keyManager) statePath() string {
+	return filepath.Join(m.dir, strings.TrimSuffix(m.zone, ".")+".json")
+}
+
+// load reads the state and the keys of the zone, a missing state is empty.
+func (m *keyManager) load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := os.ReadFile(m.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read key state: %w", err)
+	}
+	var state struct {
+		Keys []*keyState `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("unable to read key state %s: %w", m.statePath(), err)
+	}
+	for _, s := range state.Keys {
+		k, err := readKey(filepath.Join(m.dir, s.File))
+		if err != nil {
+			return fmt.Errorf("unable to read dnssec key: %w", err)
+		}
+		m.keys[s.File] = k
+	}
+	m.state = state.Keys
+	return nil
+}
+
+// save writes the state of the zone, it replaces the previous state atomically.
+func (m *keyManager) save() error {
+	b, err := json.MarshalIndent(struct {
+		Keys []*keyState `json:"keys"`
+	}{m.state}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.statePath())
+}
+
+// generate creates a key and writes its key files to the state directory.
+func (m *keyManager) generate(ksk bool) (*dnssecKey, string, error) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: m.zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: maxKeyTTL},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: rolloverAlgorithm,
+	}
+	if ksk {
+		key.Flags |= dns.SEP
+	}
+	priv, err := key.Generate(rolloverKeyBits)
+	if err != nil {
+		return nil, "", err
+	}
+	file := fmt.Sprintf("K%s+%03d+%05d", m.zone, key.Algorithm, key.KeyTag())
+	path := filepath.Join(m.dir, file)
+	if err := os.WriteFile(path+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		return nil, "", err
+	}
+	if err := os.WriteFile(path+".key", []byte(key.String()+"\n"), 0o600); err != nil {
+		return nil, "", err
+	}
+	s, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, "", fmt.Errorf("generated key does not support signing")
+	}
+	return &dnssecKey{K: key, S: s, tag: key.KeyTag()}, file, nil
+}
+
+// latest returns the key of the role that was activated last, nil if there is none.
+func (m *keyManager) latest(ksk bool) *keyState {
+	var latest *keyState
+	for _, s := range m.state {
+		if s.KSK == ksk && (latest == nil || s.Activate.After(latest.Activate)) {
+			latest = s
+		}
+	}
+	return latest
+}
+
+// successor returns the timeline of the key that replaces k.
+func (m *keyManager) successor(k *keyState) keyState {
+	if k.KSK {
+		activate := k.Inactive.Add(-dsPropagation)
+		return keyState{
+			KSK:      true,
+			Publish:  activate.Add(-keyPropagation),
+			Activate: activate,
+			Inactive: activate.Add(m.kskLifetime),
+			Delete:   activate.Add(m.kskLifetime),
+		}
+	}
+	return keyState{
+		Publish:  k.Inactive.Add(-keyPropagation),
+		Activate: k.Inactive,
+		Inactive: k.Inactive.Add(m.zskLifetime),
+		Delete:   k.Inactive.Add(m.zskLifetime + keyPropagation),
+	}
+}
+
+// rollover generates the keys that are due at now and removes the keys that were deleted.
+// It reports whether the keys changed.
+func (m *keyManager) rollover(now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := false
+	for _, ksk := range []bool{true, false} {
+		latest := m.latest(ksk)
+		var next keyState
+		switch {
+		case latest == nil:
+			lifetime := m.zskLifetime
+			if ksk {
+				lifetime = m.kskLifetime
+			}
+			next = keyState{KSK: ksk, Publish: now, Activate: now, Inactive: now.Add(lifetime), Delete: now.Add(lifetime)}
+			if !ksk {
+				next.Delete = next.Delete.Add(keyPropagation)
+			}
+		case !now.Before(m.successor(latest).Publish):
+			next = m.successor(latest)
+			if late := now.Sub(next.Publish); late > 0 {
+				// after a downtime the key is still published for the full interval before it signs, the key
+				// it replaces signs until then
+				next.Publish = now
+				next.Activate, next.Inactive, next.Delete = next.Activate.Add(late), next.Inactive.Add(late), next.Delete.Add(late)
+				latest.Inactive, latest.Delete = latest.Inactive.Add(late), latest.Delete.Add(late)
+			}
+		default:
+			continue
+		}
+		k, file, err := m.generate(ksk)
+		if err != nil {
+			return changed, fmt.Errorf("unable to generate %s: %w", next.role(), err)
+		}
+		next.File, next.Tag = file, k.tag
+		m.state = append(m.state, &next)
+		m.keys[file] = k
+		changed = true
+	}
+
+	for _, s := range m.state {
+		if s.held(now) && m.parentReplaced(s) {
+			// resolvers may still have the old DS cached
+			s.Replaced = now
+			s.Inactive, s.Delete = now.Add(keyPropagation), now.Add(keyPropagation)
+			changed = true
+		}
+	}
+
+	state := m.state[:0]
+	for _, s := range m.state {
+		if now.Before(s.Delete) || s.held(now) {
+			state = append(state, s)
+			continue
+		}
+		for _, ext := range []string{".key", ".private"} {
+			if err := os.Remove(filepath.Join(m.dir, s.File+ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("[ipecho] Warning: unable to remove retired key: %s\n", err)
+			}
+		}
+		delete(m.keys, s.File)
+		changed = true
+	}
+	m.state = state
+
+	if changed {
+		if err := m.save(); err != nil {
+			return changed, fmt.Errorf("unable to write key state: %w", err)
+		}
+	}
+	m.signer.keys.Store(m.keySet(now))
+	return changed, nil
+}
+
+// parentReplaced reports whether the DS records of the parent point to the KSK that succeeds k. A parent without
+// DS records and failed lookups are logged and reported as false, k is only retired on a positive answer.
+func (m *keyManager) parentReplaced(k *keyState) bool {
+	var next *keyState
+	for _, s := range m.state {
+		if s.KSK && s.Activate.After(k.Activate) && (next == nil || s.Activate.Before(next.Activate)) {
+			next = s
+		}
+	}
+	if next == nil || m.keys[next.File] == nil {
+		return false
+	}
+	ds, err := m.lookupDS(m.zone)
+	if err != nil {
+		log.Printf("[ipecho] Warning: unable to look up the DS of '%s', KSK %d keeps signing: %s\n", m.zone, k.Tag, err)
+		return false
+	}
+	if len(ds) == 0 {
+		log.Printf("[ipecho] Warning: the parent has no DS for '%s', KSK %d keeps signing\n", m.zone, k.Tag)
+		return false
+	}
+	key := m.keys[next.File].K
+	for _, d := range ds {
+		if nextDS := key.ToDS(d.DigestType); nextDS != nil && d.KeyTag == nextDS.KeyTag &&
+			strings.EqualFold(d.Digest, nextDS.Digest) {
+			return true
+		}
+	}
+	log.Printf("[ipecho] Warning: the DS of '%s' does not point to KSK %d yet, KSK %d keeps signing\n", m.zone, next.Tag, k.Tag)
+	return false
+}
+
+// lookupDS asks resolver, or the resolvers of the system if it is empty, for the DS records of zone.
+func lookupDS(resolver, zone string) ([]*dns.DS, error) {
+	servers := []string{resolver}
+	if resolver == "" {
+		conf, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			return nil, err
+		}
+		servers = servers[:0]
+		for _, server := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(server, conf.Port))
+		}
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(zone, dns.TypeDS)
+	c := new(dns.Client)
+	err := fmt.Errorf("no resolvers in %s", resolvConf)
+	for _, server := range servers {
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(r, server)
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		var ds []*dns.DS
+		for _, rr := range resp.Answer {
+			if d, ok := rr.(*dns.DS); ok {
+				ds = append(ds, d)
+			}
+		}
+		return ds, nil
+	}
+	return nil, err
+}
+
+// keySet returns the keys that are published and sign at now. The CDS and CDNSKEY point to the KSK that was
+// activated last, so the parent replaces its DS as soon as a new KSK signs.
+func (m *keyManager) keySet(now time.Time) *keySet {
+	set := &keySet{}
+	var newest *keyState
+	for _, s := range m.state {
+		k := m.keys[s.File]
+		if k == nil {
+			continue
+		}
+		if s.published(now) {
+			set.published = append(set.published, k)
+		}
+		if !s.active(now) {
+			continue
+		}
+		if s.KSK {
+			set.ksk = append(set.ksk, k)
+			if newest == nil || s.Activate.After(newest.Activate) {
+				newest = s
+			}
+		} else {
+			set.zsk = append(set.zsk, k)
+		}
+	}
+	if newest != nil {
+		set.cds = []*dnssecKey{m.keys[newest.File]}
+	}
+	return set
+}
+
+// timeline returns the upcoming events of the keys after now, including the next rollovers.
+func (m *keyManager) timeline(now time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type event struct {
+		at   time.Time
+		what string
+	}
+	var events []event
+	add := func(at time.Time, what string) {
+		if at.After(now) {
+			events = append(events, event{at, what})
+		}
+	}
+	for _, s := range m.state {
+		key := fmt.Sprintf("%s %d", s.role(), s.Tag)
+		add(s.Publish, key+" is published")
+		add(s.Activate, key+" signs")
+		if s.KSK {
+			if s.Replaced.IsZero() {
+				add(s.Inactive, key+" is retired once the DS of the parent points to its successor")
+			} else {
+				add(s.Inactive, key+" is retired")
+			}
+		} else {
+			add(s.Inactive, key+" stops signing")
+			add(s.Delete, key+" is retired")
+		}
+	}
+	for _, ksk := range []bool{true, false} {
+		if latest := m.latest(ksk); latest != nil {
+			next := m.successor(latest)
+			add(next.Publish, "next "+next.role()+" is generated and published")
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		lines = append(lines, e.at.UTC().Format(time.RFC3339)+" "+e.what)
+	}
+	return lines
+}
+
+// run rolls the keys over and logs the timeline if the keys changed or always is set.
+func (m *keyManager) run(always bool) error {
+	now := m.now()
+	changed, err := m.rollover(now)
+	if changed || always {
+		log.Printf("[ipecho] Upcoming key events of '%s':\n", m.zone)
+		for _, line := range m.timeline(now) {
+			log.Printf("[ipecho]   %s\n", line)
+		}
+	}
+	return err
+}
+
+func (m *keyManager) start() error {
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return fmt.Errorf("unable to create key state directory: %w", err)
+	}
+	if err := m.run(true); err != nil {
+		return err
+	}
+	m.done = make(chan struct{})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(rolloverInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				if err := m.run(false); err != nil {
+					log.Printf("[ipecho] Warning: key rollover of '%s' failed: %s\n", m.zone, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *keyManager) stop() error {
+	if m.done != nil {
+		close(m.done)
+		m.wg.Wait()
+	}
+	return nil
+}
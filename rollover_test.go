@@ -0,0 +1,191 @@
+package ipecho
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+func TestKeyRollover(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newKeyManager("example1.com.", []string{dir, "zsk", "10d", "ksk", "30d"})
+	require.NoError(t, err)
+	// parent are the DS records of the parent zone
+	var parent []*dns.DS
+	m.lookupDS = func(string) ([]*dns.DS, error) { return parent, nil }
+
+	tags := func(keys []*dnssecKey) []uint16 {
+		var tags []uint16
+		for _, k := range keys {
+			tags = append(tags, k.tag)
+		}
+		return tags
+	}
+	at := func(now time.Time) *keySet {
+		_, err := m.rollover(now)
+		require.NoError(t, err)
+		return m.signer.current()
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	set := at(start)
+	require.Equal(t, 2, len(set.published))
+	require.Equal(t, 1, len(set.ksk))
+	require.Equal(t, 1, len(set.zsk))
+	require.Equal(t, tags(set.ksk), tags(set.cds))
+	ksk1, zsk1 := set.ksk[0].tag, set.zsk[0].tag
+	parent = []*dns.DS{set.ksk[0].K.ToDS(dns.SHA256)}
+	require.FileExists(t, filepath.Join(dir, "example1.com.json"))
+	require.NotEmpty(t, m.timeline(start))
+
+	t.Run("ZSK Is Published Before It Signs", func(t *testing.T) {
+		set := at(start.Add(10*24*time.Hour - keyPropagation))
+		require.Equal(t, 3, len(set.published))
+		require.Equal(t, []uint16{zsk1}, tags(set.zsk))
+
+		set = at(start.Add(10 * 24 * time.Hour))
+		require.Equal(t, 3, len(set.published))
+		require.Equal(t, 1, len(set.zsk))
+		require.NotEqual(t, zsk1, set.zsk[0].tag)
+
+		set = at(start.Add(10*24*time.Hour + keyPropagation))
+		require.Equal(t, 2, len(set.published))
+		require.NoFileExists(t, filepath.Join(dir, fmt.Sprintf("Kexample1.com.+013+%05d.key", zsk1)))
+	})
+
+	t.Run("KSK Rollover Publishes CDS", func(t *testing.T) {
+		activate := start.Add(30*24*time.Hour - dsPropagation)
+		set := at(activate.Add(-keyPropagation))
+		require.Equal(t, []uint16{ksk1}, tags(set.ksk))
+		require.Equal(t, []uint16{ksk1}, tags(set.cds))
+		ksks := 0
+		for _, rr := range m.signer.apex(dns.TypeDNSKEY, 60) {
+			if rr.(*dns.DNSKEY).Flags&dns.SEP != 0 {
+				ksks++
+			}
+		}
+		require.Equal(t, 2, ksks, "the new KSK is published before it signs")
+
+		set = at(activate)
+		require.Equal(t, 2, len(set.ksk), "both KSKs sign the DNSKEY set")
+		require.Equal(t, 1, len(set.cds))
+		require.NotEqual(t, ksk1, set.cds[0].tag)
+		cds := m.signer.apex(dns.TypeCDS, 60)
+		require.Equal(t, 1, len(cds))
+		require.Equal(t, set.cds[0].tag, cds[0].(*dns.CDS).KeyTag)
+		require.Equal(t, 1, len(m.signer.apex(dns.TypeCDNSKEY, 60)))
+
+		set = at(start.Add(30 * 24 * time.Hour))
+		require.Equal(t, 2, len(set.ksk), "the old KSK signs until the parent replaced the DS")
+		require.Contains(t, tags(set.ksk), ksk1)
+
+		parent = nil
+		set = at(start.Add(30*24*time.Hour + rolloverInterval/2))
+		require.Contains(t, tags(set.ksk), ksk1, "an empty DS answer does not retire the old KSK")
+
+		ksk2 := set.cds[0]
+		parent = []*dns.DS{ksk2.K.ToDS(dns.SHA256)}
+		replaced := start.Add(30*24*time.Hour + rolloverInterval)
+		set = at(replaced)
+		require.Equal(t, 2, len(set.ksk), "resolvers may still have the old DS cached")
+
+		set = at(replaced.Add(keyPropagation))
+		require.Equal(t, []uint16{ksk2.tag}, tags(set.ksk))
+		require.NotContains(t, tags(set.published), ksk1)
+	})
+
+	t.Run("State Is Reloaded", func(t *testing.T) {
+		now := start.Add(30*24*time.Hour + rolloverInterval + keyPropagation)
+		reloaded, err := newKeyManager("example1.com.", []string{dir, "zsk", "10d", "ksk", "30d"})
+		require.NoError(t, err)
+		reloaded.now = func() time.Time { return now }
+		reloaded.lookupDS = m.lookupDS
+		changed, err := reloaded.rollover(now)
+		require.NoError(t, err)
+		require.False(t, changed)
+		require.Equal(t, tags(m.signer.current().published), tags(reloaded.signer.current().published))
+	})
+
+	t.Run("Downtime", func(t *testing.T) {
+		m, err := newKeyManager("example2.com.", []string{t.TempDir(), "zsk", "10d", "ksk", "30d"})
+		require.NoError(t, err)
+		m.lookupDS = func(string) ([]*dns.DS, error) { return nil, nil }
+		_, err = m.rollover(start)
+		require.NoError(t, err)
+		zsk := m.signer.current().zsk[0].tag
+
+		// the successor was due to be published two days ago
+		late := start.Add(10*24*time.Hour - keyPropagation + 2*24*time.Hour)
+		_, err = m.rollover(late)
+		require.NoError(t, err)
+		set := m.signer.current()
+		require.Equal(t, 3, len(set.published))
+		require.Equal(t, []uint16{zsk}, tags(set.zsk), "the new ZSK is published before it signs")
+
+		_, err = m.rollover(late.Add(keyPropagation - time.Second))
+		require.NoError(t, err)
+		require.Equal(t, []uint16{zsk}, tags(m.signer.current().zsk))
+
+		_, err = m.rollover(late.Add(keyPropagation))
+		require.NoError(t, err)
+		set = m.signer.current()
+		require.Equal(t, 1, len(set.zsk))
+		require.NotEqual(t, zsk, set.zsk[0].tag)
+		require.Equal(t, 3, len(set.published), "the old ZSK stays published")
+	})
+
+	t.Run("Invalid Arguments", func(t *testing.T) {
+		for _, args := range [][]string{
+			{},
+			{dir, "zsk"},
+			{dir, "zsk", "1d"},
+			{dir, "ksk", "7d"},
+			{dir, "csk", "30d"},
+			{dir, "zsk", "soon"},
+			{dir, "resolver"},
+			{dir, "resolver", "resolver.example.com"},
+			{dir, "resolver", "192.0.2.53:0"},
+		} {
+			_, err := newKeyManager("example1.com.", args)
+			require.Error(t, err, args)
+		}
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "example2.com.json"), []byte("{"), 0o600))
+		_, err := newKeyManager("example2.com.", []string{dir})
+		require.Error(t, err)
+	})
+
+	t.Run("Corefile", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte("{\ndomain example1.com {\ndnssec auto "+dir+" zsk 10d ksk 30d\n}\n}")))
+		cfg, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.NotNil(t, cfg.Domains[0].Rollover)
+		require.Equal(t, cfg.Domains[0].Rollover.signer, cfg.Domains[0].Keys)
+		require.Equal(t, "auto", cfg.Domains[0].spec().DNSSEC[0])
+
+		m, err := newKeyManager("example1.com.", []string{dir, "resolver", "2001:db8::53"})
+		require.NoError(t, err)
+		require.Equal(t, "[2001:db8::53]:53", m.resolver)
+		require.Equal(t, []string{"resolver", "[2001:db8::53]:53"}, m.args()[6:])
+
+		spec := cfg.Domains[0].spec()
+		_, err = spec.domainConfig()
+		require.Error(t, err, "rollover can not be configured by the file or the admin API")
+
+		dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte("{\ndomain example1.com {\ndnssec auto "+dir+"\ndnssec Kexample1.com.+013+00001\n}\n}")))
+		_, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+
+		dispenser = caddyfile.NewDispenser("", buffer.NewReader([]byte(
+			"{\ndomain example1.com\nview inside {\nclients 10.0.0.0/8\ndomain example1.com {\ndnssec auto "+dir+"\n}\n}\n}")))
+		_, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err, "rollover only runs for the domains of the plugin")
+	})
+}
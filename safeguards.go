@@ -0,0 +1,136 @@
+package ipecho
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/miekg/dns"
+)
+
+const (
+	spfRecord   = "v=spf1 -all"
+	dmarcRecord = "v=DMARC1; p=reject; sp=reject"
+	dmarcLabel  = "_dmarc."
+)
+
+// safeguardTypes are the types of the records a safeguarded name answers.
+var safeguardTypes = []uint16{dns.TypeMX, dns.TypeTXT, dns.TypeCAA} //nolint: gochecknoglobals // lookup table
+
+// safeguardPolicy keeps a domain from being abused for mail or certificates: the apex and every synthesized name
+// answer a null MX (RFC 7505), an SPF record without senders and CAA records that only let CAs issue, and their
+// _dmarc names answer a reject policy.
+type safeguardPolicy struct {
+	// CAs are the issuer domains of the CAA records, no CA may issue if it is empty
+	CAs []string
+}
+
+// parseSafeguardsOption parses "safeguards <ca>...", "safeguards none" or "safeguards off".
+func parseSafeguardsOption(args []string, opts *domainOptions) (option, error) {
+	if len(args) == 1 && strings.EqualFold(args[0], "off") {
+		opts.Safeguards = nil
+		return optionSafeguards, nil
+	}
+	s := &safeguardPolicy{}
+	if len(args) != 1 || !strings.EqualFold(args[0], "none") {
+		for _, arg := range args {
+			ca := strings.ToLower(strings.TrimSuffix(arg, "."))
+			if !govalidator.IsDNSName(ca) {
+				return 0, fmt.Errorf("'%s' is not a valid CA domain", arg)
+			}
+			s.CAs = append(s.CAs, ca)
+		}
+	}
+	opts.Safeguards = s
+	return optionSafeguards, nil
+}
+
+// strings returns the arguments of the safeguards option for s.
+func (s *safeguardPolicy) strings() []string {
+	switch {
+	case s == nil:
+		return []string{"off"}
+	case len(s.CAs) == 0:
+		return []string{"none"}
+	}
+	return s.CAs
+}
+
+// records returns the safeguard records of type qtype with the owner qname.
+func (s *safeguardPolicy) records(qname string, qtype uint16, ttl uint32) []dns.RR {
+	hdr := dns.RR_Header{Name: qname, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch qtype {
+	case dns.TypeMX:
+		return []dns.RR{&dns.MX{Hdr: hdr, Preference: 0, Mx: "."}}
+	case dns.TypeTXT:
+		return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{spfRecord}}}
+	case dns.TypeCAA:
+		if len(s.CAs) == 0 {
+			return []dns.RR{&dns.CAA{Hdr: hdr, Tag: "issue", Value: ";"}}
+		}
+		rrs := make([]dns.RR, 0, len(s.CAs))
+		for _, ca := range s.CAs {
+			rrs = append(rrs, &dns.CAA{Hdr: hdr, Tag: "issue", Value: ca})
+		}
+		return rrs
+	}
+	return nil
+}
+
+// dmarc returns the DMARC record with the owner qname.
+func dmarc(qname string, ttl uint32) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: []string{dmarcRecord},
+	}
+}
+
+// dmarcOwner reports whether subdomain, the part of a name in front of the domain, is the _dmarc name of the
+// apex or of a synthesized name.
+func (opts *domainOptions) dmarcOwner(subdomain string) bool {
+	subdomain = strings.ToLower(subdomain)
+	if !strings.HasPrefix(subdomain, dmarcLabel) {
+		return false
+	}
+	rest := strings.Trim(subdomain[len(dmarcLabel):], ".")
+	if rest == "" || len(opts.Default) > 0 {
+		return true
+	}
+	ip := opts.decode(rest)
+	if ip == nil {
+		ip, _, _ = opts.decodePort(rest)
+	}
+	if ip == nil {
+		return false
+	}
+	ok, _ := opts.answers(ip)
+	return ok
+}
+
+// guard adds the safeguard records of the types in safeguardTypes the name has no records of (has) to res.
+// Names with a CNAME are left alone.
+func (p *ipecho) guard(question *dns.Question, res resolution, has []uint16) resolution {
+	s := res.opts.Safeguards
+	if s == nil || containsType(has, dns.TypeCNAME) {
+		return res
+	}
+	for _, rrtype := range safeguardTypes {
+		if containsType(has, rrtype) {
+			continue
+		}
+		res.types = append(res.types, rrtype)
+		if question.Qtype == rrtype && len(res.answer) == 0 {
+			res.answer = s.records(question.Name, rrtype, res.opts.TTL)
+		}
+	}
+	return res
+}
+
+func containsType(types []uint16, rrtype uint16) bool {
+	for _, t := range types {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package ipecho
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeguards(t *testing.T) {
+	p := newTestPlugin(t, `
+		{
+			domain example1.com {
+				record @ TXT "google-site-verification=abc"
+				record mail A 192.0.2.1
+			}
+			domain example2.com {
+				safeguards off
+			}
+			domain example3.com {
+				safeguards none
+				default 127.0.0.1
+			}
+			safeguards letsencrypt.org sectigo.com
+			formats dotted dash
+		}
+	`)
+
+	for _, name := range []string{"example1.com.", "10.0.0.1.example1.com.", "app.10-0-0-1.example1.com."} {
+		require.Equal(t, []string{name + "\t2629800\tIN\tMX\t0 ."}, answers(t, p, name, dns.TypeMX))
+		require.Equal(t, []string{
+			name + "\t2629800\tIN\tCAA\t0 issue \"letsencrypt.org\"",
+			name + "\t2629800\tIN\tCAA\t0 issue \"sectigo.com\"",
+		}, answers(t, p, name, dns.TypeCAA))
+		require.Equal(t, []string{"_dmarc." + name + "\t2629800\tIN\tTXT\t\"v=DMARC1; p=reject; sp=reject\""}, answers(t, p, "_dmarc."+name, dns.TypeTXT))
+	}
+	require.Equal(t, []string{"10.0.0.1.example1.com.\t2629800\tIN\tTXT\t\"v=spf1 -all\""}, answers(t, p, "10.0.0.1.example1.com.", dns.TypeTXT))
+	require.Equal(t, []string{"example1.com.\t2629800\tIN\tTXT\t\"google-site-verification=abc\""}, answers(t, p, "example1.com.", dns.TypeTXT),
+		"static records take precedence")
+	require.Equal(t, 1, len(answers(t, p, "10-0-0-1.example1.com.", dns.TypeA)))
+	require.Empty(t, answers(t, p, "mail.example1.com.", dns.TypeMX), "names with static records are not synthesized")
+	require.Equal(t, dns.RcodeNameError, query(t, p, "_dmarc.invalid.example1.com.", dns.TypeTXT).Rcode)
+
+	m := query(t, p, "example2.com.", dns.TypeMX)
+	require.Empty(t, m.Answer, "disabled for the domain")
+	require.Empty(t, answers(t, p, "_dmarc.example2.com.", dns.TypeTXT))
+
+	require.Equal(t, []string{"example3.com.\t2629800\tIN\tCAA\t0 issue \";\""}, answers(t, p, "example3.com.", dns.TypeCAA))
+	require.Equal(t, []string{"www.example3.com.\t2629800\tIN\tMX\t0 ."}, answers(t, p, "www.example3.com.", dns.TypeMX))
+	require.Equal(t, []string{"www.example3.com.\t2629800\tIN\tA\t127.0.0.1"}, answers(t, p, "www.example3.com.", dns.TypeA))
+
+	t.Run("Spec", func(t *testing.T) {
+		spec := p.Config.findDomain("example2.com.").spec()
+		require.Equal(t, []string{"off"}, spec.Safeguards)
+		d, err := spec.domainConfig()
+		require.NoError(t, err)
+		require.Nil(t, d.Safeguards)
+		require.NotZero(t, d.set&optionSafeguards)
+
+		_, err = parseSafeguardsOption([]string{"not a domain"}, &domainOptions{})
+		require.Error(t, err)
+	})
+}
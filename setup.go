@@ -13,18 +13,95 @@ func init() {
 		ServerType: "dns",
 		Action:     setup,
 	})
+	caddy.RegisterPlugin(viewPluginName, caddy.Plugin{
+		ServerType: "dns",
+		Action:     setupView,
+	})
 }
 
 func setup(c *caddy.Controller) error {
 	c.Next()
-	config, err := newConfigFromDispenser(c.Dispenser)
+	config, err := newConfigFromDispenser(c.Dispenser, c.ServerBlockKeys...)
 	if err != nil {
 		return plugin.Error("ipecho", err)
 	}
 
+	var tap *tapper
+	if config.Dnstap != "" {
+		tap, err = newTapper(config.Dnstap)
+		if err != nil {
+			return plugin.Error("ipecho", err)
+		}
+		c.OnStartup(tap.start)
+		c.OnShutdown(tap.stop)
+	}
+
+	var stats *statistics
+	if config.Stats != "" {
+		stats = newStatistics(config.StatsWindows)
+		onListener(c, newHTTPListener("statistics", config.Stats, stats))
+	}
+
+	// views cannot sign and aliases are not signed, only the domains of the plugin roll over keys
+	for _, d := range config.Domains {
+		if d.Rollover != nil {
+			c.OnStartup(d.Rollover.start)
+			c.OnShutdown(d.Rollover.stop)
+		}
+	}
+
+	var dynamic *dynamicRecords
+	if config.Dynamic != "" {
+		dynamic, err = newDynamicRecords(config.Dynamic)
+		if err != nil {
+			return plugin.Error("ipecho", err)
+		}
+	}
+
+	var store *configStore
+	// updates bump the serial of the config
+	if config.Admin != "" || config.File != "" || config.Dynamic != "" {
+		store = newConfigStore(config)
+	}
+	var file *fileLoader
+	if config.File != "" {
+		file = newFileLoader(config.File, config.FileReload, store)
+		c.OnStartup(file.start)
+		c.OnShutdown(file.stop)
+	}
+	if config.Admin != "" {
+		onListener(c, newHTTPListener("admin API", config.Admin, newAdminAPI(config.AdminToken, store)))
+	}
+
+	if config.ACME != nil {
+		if store != nil {
+			config.ACME.config = store.Load
+		}
+		onListener(c, newHTTPListener("acme API", config.ACME.addr, config.ACME))
+	}
+
+	if len(config.TSIG) > 0 {
+		server := dnsserver.GetConfig(c)
+		if server.TsigSecret == nil {
+			server.TsigSecret = map[string]string{}
+		}
+		for name, secret := range config.TSIG {
+			server.TsigSecret[name] = secret
+		}
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return ipecho{Next: next, Config: config}
+		return ipecho{Next: next, Config: config, Store: store, File: file, Tap: tap, Stats: stats, Dynamic: dynamic}
 	})
 
 	return nil
 }
+
+// onListener registers start and stop of a listener. Caddy starts the new instance of a reload before it shuts
+// down the old one, so the listener is stopped when the reload begins and started again if the reload fails.
+func onListener(c *caddy.Controller, l *httpListener) {
+	c.OnStartup(l.start)
+	c.OnRestart(l.stop)
+	c.OnRestartFailed(l.start)
+	c.OnFinalShutdown(l.stop)
+}
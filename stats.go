@@ -0,0 +1,259 @@
+package ipecho
+
+import (
+	"container/heap"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statsSketchCapacity is the number of counters each heavy-hitter sketch keeps
+	statsSketchCapacity = 256
+	// statsSlots is the number of slots a sliding window is split into
+	statsSlots = 6
+	// statsTopN is the number of entries reported per window and dimension
+	statsTopN = 10
+)
+
+//nolint: gochecknoglobals // the windows used when none are configured
+var defaultStatsWindows = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// spaceSaving is a bounded heavy-hitter sketch (Metwally et al. "Space-Saving").
+// It never tracks more than capacity keys; a new key evicts the smallest counter
+// and inherits its count as the possible overestimation.
+type spaceSaving struct {
+	capacity int
+	counters map[string]*sketchCounter
+	// byCount is a min-heap of the counters, so adding a key takes O(log capacity)
+	byCount sketchHeap
+}
+
+type sketchCounter struct {
+	key   string
+	count uint64
+	err   uint64
+	// index is the position of the counter in byCount
+	index int
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*sketchCounter, capacity),
+		byCount:  make(sketchHeap, 0, capacity),
+	}
+}
+
+func (s *spaceSaving) add(key string) {
+	if c, ok := s.counters[key]; ok {
+		c.count++
+		heap.Fix(&s.byCount, c.index)
+		return
+	}
+	if len(s.counters) < s.capacity {
+		c := &sketchCounter{key: key, count: 1}
+		s.counters[key] = c
+		heap.Push(&s.byCount, c)
+		return
+	}
+
+	// the smallest counter is taken over by the new key
+	c := s.byCount[0]
+	delete(s.counters, c.key)
+	c.key, c.err = key, c.count
+	c.count++
+	s.counters[key] = c
+	heap.Fix(&s.byCount, 0)
+}
+
+// sketchHeap implements heap.Interface for the counters of a spaceSaving.
+type sketchHeap []*sketchCounter
+
+func (h sketchHeap) Len() int           { return len(h) }
+func (h sketchHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h sketchHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *sketchHeap) Push(x interface{}) {
+	c := x.(*sketchCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *sketchHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// slidingWindow approximates a sliding window with statsSlots tumbling sketches.
+type slidingWindow struct {
+	window  time.Duration
+	slots   []*spaceSaving
+	current int
+	started time.Time
+}
+
+func newSlidingWindow(window time.Duration, now time.Time) *slidingWindow {
+	w := &slidingWindow{
+		window:  window,
+		slots:   make([]*spaceSaving, statsSlots),
+		started: now,
+	}
+	for i := range w.slots {
+		w.slots[i] = newSpaceSaving(statsSketchCapacity)
+	}
+	return w
+}
+
+func (w *slidingWindow) rotate(now time.Time) {
+	slot := w.window / statsSlots
+	for i := 0; i < statsSlots && now.Sub(w.started) >= slot; i++ {
+		w.current = (w.current + 1) % statsSlots
+		w.slots[w.current] = newSpaceSaving(statsSketchCapacity)
+		w.started = w.started.Add(slot)
+	}
+	if now.Sub(w.started) >= slot {
+		// idle for longer than the whole window, everything has been reset already
+		w.started = now
+	}
+}
+
+func (w *slidingWindow) add(key string, now time.Time) {
+	w.rotate(now)
+	w.slots[w.current].add(key)
+}
+
+type statsEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	// Error is the maximum overestimation of Count caused by evictions
+	Error uint64 `json:"error"`
+}
+
+func (w *slidingWindow) top(n int, now time.Time) []statsEntry {
+	w.rotate(now)
+	merged := make(map[string]*statsEntry)
+	for _, slot := range w.slots {
+		for key, c := range slot.counters {
+			e, ok := merged[key]
+			if !ok {
+				e = &statsEntry{Key: key}
+				merged[key] = e
+			}
+			e.Count += c.count
+			e.Error += c.err
+		}
+	}
+
+	entries := make([]statsEntry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+type windowStats struct {
+	ips     *slidingWindow
+	clients *slidingWindow
+	domains *slidingWindow
+}
+
+// statistics keeps the most queried addresses, clients and domains and serves them as JSON.
+type statistics struct {
+	mu      sync.Mutex
+	since   time.Time
+	windows []windowStats
+	totals  map[string]uint64
+}
+
+func newStatistics(windows []time.Duration) *statistics {
+	if len(windows) == 0 {
+		windows = defaultStatsWindows
+	}
+	now := time.Now()
+	s := &statistics{
+		since:  now,
+		totals: make(map[string]uint64),
+	}
+	for _, window := range windows {
+		s.windows = append(s.windows, windowStats{
+			ips:     newSlidingWindow(window, now),
+			clients: newSlidingWindow(window, now),
+			domains: newSlidingWindow(window, now),
+		})
+	}
+	return s
+}
+
+// record counts one answered query.
+func (s *statistics) record(ip net.IP, client, domain string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totals[domain]++
+	for _, w := range s.windows {
+		w.ips.add(ip.String(), now)
+		w.clients.add(client, now)
+		w.domains.add(domain, now)
+	}
+}
+
+type statsWindowReport struct {
+	Window  string       `json:"window"`
+	IPs     []statsEntry `json:"ips"`
+	Clients []statsEntry `json:"clients"`
+	Domains []statsEntry `json:"domains"`
+}
+
+type statsReport struct {
+	Since   time.Time           `json:"since"`
+	Totals  map[string]uint64   `json:"totals"`
+	Windows []statsWindowReport `json:"windows"`
+}
+
+func (s *statistics) report() statsReport {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := statsReport{
+		Since:  s.since,
+		Totals: make(map[string]uint64, len(s.totals)),
+	}
+	for domain, count := range s.totals {
+		r.Totals[domain] = count
+	}
+	for _, w := range s.windows {
+		r.Windows = append(r.Windows, statsWindowReport{
+			Window:  w.ips.window.String(),
+			IPs:     w.ips.top(statsTopN, now),
+			Clients: w.clients.top(statsTopN, now),
+			Domains: w.domains.top(statsTopN, now),
+		})
+	}
+	return r
+}
+
+func (s *statistics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.report())
+}
@@ -0,0 +1,106 @@
+package ipecho
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(2)
+	s.add("a")
+	s.add("a")
+	s.add("b")
+	s.add("c")
+	require.Equal(t, 2, len(s.counters))
+	require.Equal(t, uint64(2), s.counters["a"].count)
+	require.Equal(t, uint64(2), s.counters["c"].count)
+	require.Equal(t, uint64(1), s.counters["c"].err)
+}
+
+func TestSpaceSavingEvictsSmallest(t *testing.T) {
+	s := newSpaceSaving(3)
+	for i, key := range []string{"a", "a", "a", "b", "b", "b", "c", "d", "e", "a"} {
+		s.add(key)
+		require.Equal(t, len(s.counters), len(s.byCount), "after %d adds", i+1)
+	}
+	require.Equal(t, uint64(4), s.counters["a"].count)
+	require.Equal(t, uint64(3), s.counters["b"].count)
+	require.Equal(t, uint64(3), s.counters["e"].count)
+	require.Equal(t, uint64(2), s.counters["e"].err)
+	require.NotContains(t, s.counters, "d")
+	for i, c := range s.byCount {
+		require.Equal(t, i, c.index)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Now()
+	w := newSlidingWindow(time.Minute, now)
+	for i := 0; i < 3; i++ {
+		w.add("127.0.0.1", now)
+	}
+	w.add("::1", now.Add(30*time.Second))
+
+	top := w.top(10, now.Add(30*time.Second))
+	require.Equal(t, []statsEntry{{Key: "127.0.0.1", Count: 3}, {Key: "::1", Count: 1}}, top)
+
+	// the first slot slides out of the window
+	top = w.top(10, now.Add(65*time.Second))
+	require.Equal(t, []statsEntry{{Key: "::1", Count: 1}}, top)
+
+	// idle for longer than the window
+	require.Empty(t, w.top(10, now.Add(time.Hour)))
+
+	for i := 0; i < 20; i++ {
+		w.add(strconv.Itoa(i), now.Add(time.Hour))
+	}
+	require.Equal(t, 5, len(w.top(5, now.Add(time.Hour))))
+}
+
+func TestStatistics(t *testing.T) {
+	stats := newStatistics([]time.Duration{time.Minute})
+	p := ipecho{
+		Config: &config{
+			Domains:       []*domainConfig{{Name: "example1.com."}, {Name: "example2.com."}},
+			domainOptions: domainOptions{TTL: 60},
+		},
+		Stats: stats,
+	}
+
+	query := func(client, name string) {
+		d := &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP(client), Port: 53}}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: dns.TypeA}},
+		})
+	}
+	query("192.0.2.1", "127.0.0.1.example1.com.")
+	query("192.0.2.1", "127.0.0.1.example1.com.")
+	query("192.0.2.2", "127.0.0.2.example2.com.")
+	query("192.0.2.2", "test.example2.com.")
+
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var report statsReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	require.Equal(t, map[string]uint64{"example1.com.": 2, "example2.com.": 1}, report.Totals)
+	require.Equal(t, 1, len(report.Windows))
+	require.Equal(t, "1m0s", report.Windows[0].Window)
+	require.Equal(t, []statsEntry{{Key: "127.0.0.1", Count: 2}, {Key: "127.0.0.2", Count: 1}}, report.Windows[0].IPs)
+	require.Equal(t, []statsEntry{{Key: "192.0.2.1", Count: 2}, {Key: "192.0.2.2", Count: 1}}, report.Windows[0].Clients)
+	require.Equal(t, []statsEntry{{Key: "example1.com.", Count: 2}, {Key: "example2.com.", Count: 1}}, report.Windows[0].Domains)
+
+	rec = httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,50 @@
+package ipecho
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configStore holds a config that can be replaced while queries are being served.
+// Readers always get a complete config, writers never modify a published config in place.
+type configStore struct {
+	value atomic.Value
+	// mu serializes writers, so concurrent updates do not get lost
+	mu sync.Mutex
+}
+
+func newConfigStore(cfg *config) *configStore {
+	s := &configStore{}
+	s.value.Store(cfg)
+	return s
+}
+
+// Load returns the current config, it must not be modified.
+func (s *configStore) Load() *config {
+	return s.value.Load().(*config)
+}
+
+// Update applies fn to a copy of the current config and publishes the copy if fn succeeds.
+func (s *configStore) Update(fn func(cfg *config) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg := s.Load().clone()
+	if err := fn(cfg); err != nil {
+		return err
+	}
+	cfg.Serial = nextSerial(cfg.Serial)
+	s.value.Store(cfg)
+	return nil
+}
+
+// nextSerial returns the SOA serial of a changed config, the current time unless serial is not older.
+// Secondaries then transfer the domains again.
+func nextSerial(serial uint32) uint32 {
+	now := uint32(time.Now().Unix())
+	// serial number arithmetic, RFC 1982
+	if int32(now-serial) > 0 {
+		return now
+	}
+	return serial + 1
+}
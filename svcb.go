@@ -0,0 +1,66 @@
+package ipecho
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+func parseALPNOption(args []string, opts *domainOptions) (option, error) {
+	for _, arg := range args {
+		if len(arg) > 255 {
+			return 0, fmt.Errorf("alpn protocol id '%s' is too long", arg)
+		}
+	}
+	opts.ALPN = args
+	return optionALPN, nil
+}
+
+func parsePortOption(args []string, opts *domainOptions) (option, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("port takes exactly one value")
+	}
+	port, err := parsePort(args[0])
+	if err != nil {
+		return 0, err
+	}
+	opts.Port = port
+	return optionPort, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	//nolint: gomnd // parse port as uint16 with base 10
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port: '%s'", s)
+	}
+	return uint16(port), nil
+}
+
+// serviceBinding returns the HTTPS or SVCB record (RFC 9460) of a name with the embedded address ip. The record
+// points to target ("." for the name itself) and carries the alpn of the domain, port and ip as address hint.
+func serviceBinding(qname string, qtype uint16, ip net.IP, port uint16, target string, opts *domainOptions) dns.RR {
+	svcb := dns.SVCB{
+		Hdr:      dns.RR_Header{Name: qname, Rrtype: qtype, Class: dns.ClassINET, Ttl: opts.TTL},
+		Priority: 1,
+		Target:   target,
+	}
+	// the keys have to be in ascending order
+	if len(opts.ALPN) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: opts.ALPN})
+	}
+	if port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: port})
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: []net.IP{ip4}})
+	} else {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{ip}})
+	}
+	if qtype == dns.TypeHTTPS {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
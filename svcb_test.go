@@ -0,0 +1,37 @@
+package ipecho
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceBinding(t *testing.T) {
+	p := newTestPlugin(t, `
+		{
+			domain example1.com
+			domain example2.com {
+				alpn h2 h3
+				port 8443
+				nat 10.0.0.0/24 203.0.113.0/24
+			}
+			ttl 60
+		}
+	`)
+
+	require.Equal(t, []string{"10.0.0.1.example1.com.\t60\tIN\tHTTPS\t1 . ipv4hint=\"10.0.0.1\""}, answers(t, p, "10.0.0.1.example1.com.", dns.TypeHTTPS))
+	require.Equal(t, []string{"::1.example1.com.\t60\tIN\tSVCB\t1 . ipv6hint=\"::1\""}, answers(t, p, "::1.example1.com.", dns.TypeSVCB))
+	require.Equal(t, []string{"10.0.0.1.example2.com.\t60\tIN\tHTTPS\t1 . alpn=\"h2,h3\" port=\"8443\" ipv4hint=\"203.0.113.1\""},
+		answers(t, p, "10.0.0.1.example2.com.", dns.TypeHTTPS))
+	require.Empty(t, answers(t, p, "example1.com.", dns.TypeHTTPS), "only names with an embedded address")
+
+	spec := p.Config.findDomain("example2.com.").spec()
+	require.Equal(t, []string{"h2", "h3"}, spec.ALPN)
+	require.Equal(t, uint16(8443), *spec.Port)
+
+	_, err := parsePortOption([]string{"65536"}, &domainOptions{})
+	require.Error(t, err)
+	_, err = parsePortOption([]string{"0"}, &domainOptions{})
+	require.Error(t, err)
+}
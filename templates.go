@@ -0,0 +1,133 @@
+package ipecho
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// answerTemplate renders the data of a record from the address embedded in the query name.
+type answerTemplate struct {
+	// Type of the rendered record
+	Type uint16
+	// Text is the template of the record data in zone file syntax
+	Text string
+	tmpl *template.Template
+}
+
+// templateData is passed to an answer template.
+type templateData struct {
+	// IP is the decoded address, e.g. 10.0.0.1 or 2001:db8::1
+	IP string
+	// Dashed is the decoded address with dashes, e.g. 10-0-0-1 or 2001-db8--1
+	Dashed string
+	// Labels are the labels in front of the domain
+	Labels []string
+	// Client is the address of the client
+	Client string
+	// Domain is the matched domain, fully qualified
+	Domain string
+	// Name is the query name, fully qualified
+	Name string
+}
+
+// newTemplateData returns the data for the answer templates of qname.
+func newTemplateData(qname, domain, subdomain string, ip net.IP, client string) *templateData {
+	return &templateData{
+		IP:     ip.String(),
+		Dashed: dashed(ip),
+		Labels: dns.SplitDomainName(subdomain),
+		Client: client,
+		Domain: domain,
+		Name:   qname,
+	}
+}
+
+// dashed returns ip with dashes instead of dots or colons, e.g. 10-0-0-1 or 2001-db8--1.
+func dashed(ip net.IP) string {
+	if ip.To4() != nil {
+		return strings.ReplaceAll(ip.String(), ".", "-")
+	}
+	return strings.ReplaceAll(ip.String(), ":", "-")
+}
+
+// parseAnswerTemplate parses the template text for records of type typ.
+// It renders the template once with example data to report errors when the config is loaded.
+func parseAnswerTemplate(domain, typ, text string) (*answerTemplate, error) {
+	rrtype, ok := dns.StringToType[strings.ToUpper(typ)]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type '%s'", typ)
+	}
+	tmpl, err := template.New(typ).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for %s: %w", typ, err)
+	}
+	t := &answerTemplate{Type: rrtype, Text: text, tmpl: tmpl}
+	example := newTemplateData(dns.Fqdn("192-0-2-1."+strings.TrimSuffix(domain, ".")), domain, "192-0-2-1", net.ParseIP("192.0.2.1"), "192.0.2.2")
+	if _, err := t.render(example, 0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// render returns the record for data.
+func (t *answerTemplate) render(data *templateData, ttl uint32) (dns.RR, error) {
+	var rdata strings.Builder
+	if err := t.tmpl.Execute(&rdata, data); err != nil {
+		return nil, fmt.Errorf("unable to render %s template: %w", dns.TypeToString[t.Type], err)
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", data.Name, ttl, dns.TypeToString[t.Type], rdata.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record '%s': %w", dns.TypeToString[t.Type], rdata.String(), err)
+	}
+	if rr == nil || rr.Header().Rrtype != t.Type {
+		return nil, fmt.Errorf("invalid %s record '%s'", dns.TypeToString[t.Type], rdata.String())
+	}
+	return rr, nil
+}
+
+// answerTemplates are the templates of a domain, keyed by record type.
+type answerTemplates map[uint16]*answerTemplate
+
+// find returns the template for qtype, or the CNAME template if there is none.
+func (a answerTemplates) find(qtype uint16) *answerTemplate {
+	if t, ok := a[qtype]; ok {
+		return t
+	}
+	return a[dns.TypeCNAME]
+}
+
+// texts returns the template texts keyed by the name of the record type.
+func (a answerTemplates) texts() map[string]string {
+	if len(a) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(a))
+	for _, t := range a {
+		m[dns.TypeToString[t.Type]] = t.Text
+	}
+	return m
+}
+
+// parseAnswerTemplates parses templates keyed by the name of the record type.
+func parseAnswerTemplates(domain string, texts map[string]string) (answerTemplates, error) {
+	types := make([]string, 0, len(texts))
+	for typ := range texts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	a := answerTemplates{}
+	for _, typ := range types {
+		t, err := parseAnswerTemplate(domain, typ, texts[typ])
+		if err != nil {
+			return nil, err
+		}
+		a[t.Type] = t
+	}
+	return a, nil
+}
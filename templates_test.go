@@ -0,0 +1,99 @@
+package ipecho
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+func TestParseAnswerTemplate(t *testing.T) {
+	tmpl, err := parseAnswerTemplate("example1.com.", "mx", "10 mail.{{.Name}}")
+	require.NoError(t, err)
+	require.Equal(t, dns.TypeMX, tmpl.Type)
+
+	for _, tc := range []struct{ typ, text string }{
+		{"NOPE", "{{.IP}}"},
+		{"TXT", "{{.IP"},
+		{"TXT", "{{.Unknown}}"},
+		{"CNAME", "{{.IP}} {{.IP}}"},
+		{"MX", "mail.{{.Name}}"},
+	} {
+		_, err := parseAnswerTemplate("example1.com.", tc.typ, tc.text)
+		require.Error(t, err, tc.text)
+	}
+}
+
+func TestServeDNSTemplates(t *testing.T) {
+	p := newTestPlugin(t, `
+		{
+			domain example1.com {
+				template TXT "ip={{.IP}} client={{.Client}}"
+				template CNAME {{.Dashed}}.cdn.example.net.
+				template MX 10 mail.{{.Name}}
+				template PTR {{index .Labels 0}}.{{.Domain}}
+			}
+			ttl 60
+		}
+	`)
+	require.Equal(t, map[string]string{
+		"TXT":   `"ip={{.IP}} client={{.Client}}"`,
+		"CNAME": "{{.Dashed}}.cdn.example.net.",
+		"MX":    "10 mail.{{.Name}}",
+		"PTR":   "{{index .Labels 0}}.{{.Domain}}",
+	}, p.Config.Domains[0].spec().Templates)
+
+	queryClient := func(name string, qtype uint16) *dns.Msg {
+		return queryFrom(t, p, &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}}, name, qtype)
+	}
+
+	t.Run("TXT", func(t *testing.T) {
+		m := queryClient("127.0.0.1.example1.com.", dns.TypeTXT)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+		require.Equal(t, []string{"ip=127.0.0.1 client=192.0.2.1"}, m.Answer[0].(*dns.TXT).Txt)
+	})
+
+	t.Run("MX", func(t *testing.T) {
+		m := queryClient("127-0-0-1.example1.com.", dns.TypeMX)
+		require.Equal(t, 0, len(m.Answer), "dash format is not enabled")
+
+		m = queryClient("127.0.0.1.example1.com.", dns.TypeMX)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, uint16(10), m.Answer[0].(*dns.MX).Preference)
+		require.Equal(t, "mail.127.0.0.1.example1.com.", m.Answer[0].(*dns.MX).Mx)
+	})
+
+	t.Run("Labels", func(t *testing.T) {
+		m := queryClient("::1.example1.com.", dns.TypePTR)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "::1.example1.com.", m.Answer[0].(*dns.PTR).Ptr)
+	})
+
+	t.Run("CNAME For Other Types", func(t *testing.T) {
+		m := queryClient("::1.example1.com.", dns.TypeAAAA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "--1.cdn.example.net.", m.Answer[0].(*dns.CNAME).Target)
+	})
+
+	t.Run("Invalid Address", func(t *testing.T) {
+		m := queryClient("test.example1.com.", dns.TypeTXT)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+	})
+
+	t.Run("Duplicate Template", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain example1.com {
+					template TXT {{.IP}}
+					template txt {{.Client}}
+				}
+			}
+		`)))
+		_, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+	})
+}
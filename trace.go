@@ -0,0 +1,25 @@
+package ipecho
+
+import (
+	"context"
+
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// startSpan starts a child of the span the trace plugin stored in ctx.
+// Without the trace plugin a no-op span is returned, so callers never have to check for nil.
+func startSpan(ctx context.Context, stage string) ot.Span {
+	parent := ot.SpanFromContext(ctx)
+	if parent == nil {
+		return ot.NoopTracer{}.StartSpan(stage)
+	}
+	return parent.Tracer().StartSpan("ipecho."+stage, ot.ChildOf(parent.Context()))
+}
+
+// tagSpan records the matched domain (if any) and the outcome of a stage.
+func tagSpan(span ot.Span, domain, outcome string) {
+	if domain != "" {
+		span.SetTag("ipecho.domain", domain)
+	}
+	span.SetTag("ipecho.outcome", outcome)
+}
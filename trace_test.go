@@ -0,0 +1,64 @@
+package ipecho
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	p := ipecho{
+		Config: &config{
+			Domains:       []*domainConfig{{Name: "example1.com."}},
+			domainOptions: domainOptions{TTL: 60},
+		},
+	}
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("servedns")
+	ctx := ot.ContextWithSpan(context.Background(), root)
+
+	d := &dummyResponseWriter{}
+	p.ServeDNS(ctx, d, &dns.Msg{
+		Question: []dns.Question{
+			{
+				Name:   "127.0.0.1.example1.com.",
+				Qclass: dns.ClassINET,
+				Qtype:  dns.TypeA,
+			},
+		},
+	})
+	require.Equal(t, 1, len(d.GetMsgs()))
+
+	spans := tracer.FinishedSpans()
+	require.Equal(t, 4, len(spans))
+	for i, stage := range []string{"ipecho.match", "ipecho.decode", "ipecho.policy", "ipecho.write"} {
+		require.Equal(t, stage, spans[i].OperationName)
+		require.Equal(t, root.Context().(mocktracer.MockSpanContext).SpanID, spans[i].ParentID)
+	}
+	require.Equal(t, "example1.com.", spans[0].Tag("ipecho.domain"))
+	require.Equal(t, "matched", spans[0].Tag("ipecho.outcome"))
+	require.Equal(t, "decoded", spans[1].Tag("ipecho.outcome"))
+	require.Equal(t, "allowed", spans[2].Tag("ipecho.outcome"))
+	require.Equal(t, "written", spans[3].Tag("ipecho.outcome"))
+	require.Equal(t, "example1.com.", spans[3].Tag("ipecho.domain"))
+
+	t.Run("Without Trace Plugin", func(t *testing.T) {
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{
+				{
+					Name:   "test.example1.com.",
+					Qclass: dns.ClassINET,
+					Qtype:  dns.TypeA,
+				},
+			},
+		})
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeNameError, d.GetMsgs()[0].Rcode)
+	})
+}
@@ -0,0 +1,312 @@
+package ipecho
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxEnumerated is the largest number of addresses a network of enumerate can have
+	maxEnumerated = 1024
+	// transferChunk is the number of records sent in one message of a transfer
+	transferChunk = 100
+)
+
+// parseEnumerateOption parses the networks whose addresses are listed in zone transfers.
+func parseEnumerateOption(args []string, opts *domainOptions) (option, error) {
+	networks, err := parseNetworks(args)
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range networks {
+		ones, bits := n.Mask.Size()
+		if bits-ones > 30 || 1<<(bits-ones) > maxEnumerated {
+			return 0, fmt.Errorf("network '%s' has more than %d addresses", n, maxEnumerated)
+		}
+	}
+	opts.Enumerate = networks
+	return optionEnumerate, nil
+}
+
+// parseTransferOption parses "transfer <network>... [key <name>...]", transfers of clients in the networks have to
+// be signed with one of the keys if any are given.
+func parseTransferOption(args []string, opts *domainOptions) (option, error) {
+	var keys []string
+	for i, arg := range args {
+		if strings.EqualFold(arg, "key") {
+			args, keys = args[:i], args[i+1:]
+			if len(keys) == 0 {
+				return 0, fmt.Errorf("transfer key needs the name of a tsig key")
+			}
+			break
+		}
+	}
+	networks, err := parseNetworks(args)
+	if err != nil {
+		return 0, err
+	}
+	opts.Transfer, opts.TransferKeys = networks, nil
+	for _, key := range keys {
+		opts.TransferKeys = append(opts.TransferKeys, dns.CanonicalName(key))
+	}
+	return optionTransfer, nil
+}
+
+// transferStrings returns the arguments of the transfer option of opts.
+func (opts *domainOptions) transferStrings() []string {
+	s := networkStrings(opts.Transfer)
+	if len(opts.TransferKeys) > 0 {
+		s = append(append(s, "key"), opts.TransferKeys...)
+	}
+	return s
+}
+
+// checkTransferKeys reports an error if a transfer needs a TSIG key that is not configured.
+func (cfg *config) checkTransferKeys() error {
+	keys := cfg.TransferKeys
+	for _, d := range cfg.Domains {
+		keys = append(keys, cfg.effectiveOptions(d).TransferKeys...)
+	}
+	for _, key := range keys {
+		if _, ok := cfg.TSIG[key]; !ok {
+			return fmt.Errorf("transfer uses the unknown tsig key '%s'", key)
+		}
+	}
+	return nil
+}
+
+// parseTSIGPart parses a TSIG key, "tsig <name> <secret>". The secret is base64 encoded.
+func parseTSIGPart(args []string, cfg *config) error {
+	//nolint: gomnd // key name and secret
+	if len(args) != 2 {
+		return fmt.Errorf("tsig takes a key name and a secret")
+	}
+	if cfg.TSIG == nil {
+		cfg.TSIG = map[string]string{}
+	}
+	cfg.TSIG[dns.CanonicalName(args[0])] = args[1]
+	return nil
+}
+
+// transferAllowed reports whether the client may transfer the domain. Clients have to be in the transfer networks
+// of the domain and, if the domain has transfer keys, sign the request with one of them.
+func (p *ipecho) transferAllowed(w dns.ResponseWriter, r *dns.Msg, opts *domainOptions) bool {
+	addr := net.ParseIP(clientIP(w))
+	allowed := false
+	for _, n := range opts.Transfer {
+		if addr != nil && n.Contains(addr) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if len(opts.TransferKeys) == 0 {
+		return true
+	}
+	t := r.IsTsig()
+	if t == nil || w.TsigStatus() != nil {
+		return false
+	}
+	for _, key := range opts.TransferKeys {
+		if strings.EqualFold(key, t.Hdr.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// transfer answers an AXFR or IXFR request for one of the domains. IXFR is answered with the full zone unless the
+// client is up to date. It reports false if the request is not for a domain.
+func (p *ipecho) transfer(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, bool) {
+	question := r.Question[0]
+	domain := p.Config.findDomain(strings.ToLower(question.Name))
+	if domain == nil {
+		return dns.RcodeSuccess, false
+	}
+	opts := p.Config.effectiveOptions(domain)
+	// signed domains are signed online, secondaries could not answer with signatures
+	if domain.Keys != nil || !p.transferAllowed(w, r, &opts) {
+		if p.Config.Debug {
+			log.Printf("[ipecho] Refusing transfer of '%s' to '%s'\n", question.Name, clientIP(w))
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		signReply(w, r, m)
+		p.writeMsg(ctx, w, r, m, domain.Name, time.Now())
+		return dns.RcodeRefused, true
+	}
+
+	soa := p.Config.soa(domain.Name, &opts)
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if question.Qtype == dns.TypeIXFR && (udp || ixfrUpToDate(r, soa.Serial)) {
+		// a single SOA tells the client that it is up to date or has to retry over TCP
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{soa}
+		signReply(w, r, m)
+		p.writeMsg(ctx, w, r, m, domain.Name, time.Now())
+		return dns.RcodeSuccess, true
+	}
+	if udp {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		signReply(w, r, m)
+		p.writeMsg(ctx, w, r, m, domain.Name, time.Now())
+		return dns.RcodeRefused, true
+	}
+
+	records := p.Config.zone(domain, &opts, p.Dynamic.domain(domain.Name))
+	if p.Config.Debug {
+		log.Printf("[ipecho] Transferring %d records of '%s' to '%s'\n", len(records), domain.Name, clientIP(w))
+	}
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for len(records) > 0 {
+			n := transferChunk
+			if n > len(records) {
+				n = len(records)
+			}
+			ch <- &dns.Envelope{RR: records[:n]}
+			records = records[n:]
+		}
+	}()
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, r, ch); err != nil {
+		log.Printf("[ipecho] Warning: transfer of '%s' to '%s' failed: %s\n", domain.Name, clientIP(w), err)
+		for range ch {
+		}
+	}
+	return dns.RcodeSuccess, true
+}
+
+// signReply signs m with the TSIG key of the request r, as the transferred zone is, if r has a valid signature.
+func signReply(w dns.ResponseWriter, r, m *dns.Msg) {
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+	}
+}
+
+// ixfrUpToDate reports whether the SOA in the authority section of the IXFR request r is not older than serial.
+func ixfrUpToDate(r *dns.Msg, serial uint32) bool {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			// serial number arithmetic, RFC 1982
+			return int32(serial-soa.Serial) <= 0
+		}
+	}
+	return false
+}
+
+// zone returns the records of domain as they are transferred, starting and ending with the SOA: the NS records,
+// the static and updated records, the default addresses and safeguards of the apex and the addresses of the
+// enumerated networks. Names with an embedded address are only listed for the enumerated networks.
+func (cfg *config) zone(domain *domainConfig, opts *domainOptions, dynamic staticRecords) []dns.RR {
+	soa := cfg.soa(domain.Name, opts)
+	rrs := []dns.RR{soa}
+	if !hasType(domain.Records[domain.Name], dns.TypeNS) {
+		rrs = append(rrs, cfg.nameservers(domain.Name, opts.TTL)...)
+	}
+
+	// the static records take precedence over the updated ones
+	records := make(staticRecords, len(dynamic)+len(domain.Records))
+	for name, r := range dynamic {
+		records[name] = r
+	}
+	for name, r := range domain.Records {
+		records[name] = r
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, rr := range records[name] {
+			rrs = append(rrs, staticCopy(rr, name, opts.TTL))
+		}
+	}
+	if _, ok := records[domain.Name]; !ok {
+		for _, ip := range opts.Default {
+			rrs = append(rrs, addressRecord(domain.Name, ip, opts.TTL))
+		}
+	}
+
+	if opts.Safeguards != nil {
+		has := records.types(domain.Name)
+		for _, rrtype := range safeguardTypes {
+			if !containsType(has, rrtype) && !containsType(has, dns.TypeCNAME) {
+				rrs = append(rrs, opts.Safeguards.records(domain.Name, rrtype, opts.TTL)...)
+			}
+		}
+		if _, ok := records[dmarcLabel+domain.Name]; !ok {
+			rrs = append(rrs, dmarc(dmarcLabel+domain.Name, opts.TTL))
+		}
+	}
+
+	for _, n := range opts.Enumerate {
+		for _, ip := range enumerate(n) {
+			name := encodeIP(ip, opts.Formats) + "." + domain.Name
+			if _, ok := records[name]; ok {
+				continue
+			}
+			if ok, _ := opts.answers(ip); !ok {
+				continue
+			}
+			rrs = append(rrs, addressRecord(name, translate(opts.NAT, ip), opts.TTL))
+		}
+	}
+	return append(rrs, soa)
+}
+
+func hasType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// addressRecord returns the A or AAAA record for ip.
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{Name: name, Rrtype: addressType(ip), Class: dns.ClassINET, Ttl: ttl}
+	if hdr.Rrtype == dns.TypeA {
+		return &dns.A{Hdr: hdr, A: ip}
+	}
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// enumerate returns the addresses of n.
+func enumerate(n *net.IPNet) []net.IP {
+	ones, bits := n.Mask.Size()
+	count := 1 << (bits - ones)
+	ips := make([]net.IP, 0, count)
+	base := new(big.Int).SetBytes(n.IP.Mask(n.Mask))
+	for i := 0; i < count; i++ {
+		b := new(big.Int).Add(base, big.NewInt(int64(i))).Bytes()
+		ip := make(net.IP, len(n.IP))
+		copy(ip[len(ip)-len(b):], b)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// encodeIP returns the label of ip in the first of formats, the dotted format is preferred.
+func encodeIP(ip net.IP, formats format) string {
+	if formats&formatDotted != 0 {
+		return ip.String()
+	}
+	return dashed(ip)
+}
@@ -0,0 +1,228 @@
+package ipecho
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+// tsigResponseWriter reports the outcome of the TSIG verification of the server.
+type tsigResponseWriter struct {
+	*dummyResponseWriter
+	status error
+}
+
+func (w *tsigResponseWriter) TsigStatus() error { return w.status }
+
+func TestTransfer(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example1.com {
+				record @ MX 10 mail.example1.com.
+				record mail A 192.0.2.1
+				enumerate 10.0.0.0/30
+				deny 10.0.0.2
+				transfer 192.0.2.0/24
+			}
+			domain example2.com
+			ttl 60
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	p := ipecho{Config: cfg}
+
+	transfer := func(w dns.ResponseWriter, name string, qtype uint16) []*dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		p.ServeDNS(context.Background(), w, r)
+		switch w := w.(type) {
+		case *dummyResponseWriter:
+			return w.GetMsgs()
+		case *tsigResponseWriter:
+			return w.GetMsgs()
+		}
+		return nil
+	}
+	tcp := func(client string) *dummyResponseWriter {
+		return &dummyResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP(client), Port: 53}}
+	}
+
+	t.Run("AXFR", func(t *testing.T) {
+		msgs := transfer(tcp("192.0.2.53"), "example1.com.", dns.TypeAXFR)
+		require.Equal(t, 1, len(msgs))
+		var names []string
+		for _, rr := range msgs[0].Answer {
+			names = append(names, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+		}
+		require.Equal(t, []string{
+			"example1.com. SOA",
+			"example1.com. NS",
+			"example1.com. MX",
+			"mail.example1.com. A",
+			"10.0.0.0.example1.com. A",
+			"10.0.0.1.example1.com. A",
+			"10.0.0.3.example1.com. A",
+			"example1.com. SOA",
+		}, names)
+		require.Equal(t, uint32(60), msgs[0].Answer[3].Header().Ttl)
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		msgs := transfer(tcp("198.51.100.1"), "example1.com.", dns.TypeAXFR)
+		require.Equal(t, dns.RcodeRefused, msgs[0].Rcode)
+
+		msgs = transfer(tcp("192.0.2.53"), "example2.com.", dns.TypeAXFR)
+		require.Equal(t, dns.RcodeRefused, msgs[0].Rcode, "example2.com has no transfer networks")
+
+		msgs = transfer(&dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}}, "example1.com.", dns.TypeAXFR)
+		require.Equal(t, dns.RcodeRefused, msgs[0].Rcode, "AXFR needs TCP")
+	})
+
+	t.Run("IXFR", func(t *testing.T) {
+		msgs := transfer(tcp("192.0.2.53"), "example1.com.", dns.TypeIXFR)
+		require.Equal(t, 8, len(msgs[0].Answer), "unknown serial gets the full zone")
+
+		r := new(dns.Msg)
+		r.SetIxfr("example1.com.", cfg.Serial, "", "")
+		w := tcp("192.0.2.53")
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, 1, len(w.GetMsgs()[0].Answer), "up to date")
+
+		msgs = transfer(&dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}}, "example1.com.", dns.TypeIXFR)
+		require.Equal(t, 1, len(msgs[0].Answer), "IXFR over UDP gets the SOA only")
+	})
+
+	t.Run("TSIG", func(t *testing.T) {
+		require.NoError(t, parseTSIGPart([]string{"transfer.", "c2VjcmV0"}, cfg))
+		require.NoError(t, parseTSIGPart([]string{"update.", "c2VjcmV0"}, cfg))
+		d := cfg.Domains[0]
+		defer func() { cfg.TSIG, d.TransferKeys = nil, nil }()
+
+		msgs := transfer(tcp("192.0.2.53"), "example1.com.", dns.TypeAXFR)
+		require.Equal(t, 8, len(msgs[0].Answer), "the domain has no transfer keys")
+
+		_, err := parseTransferOption([]string{"192.0.2.0/24", "key", "Transfer"}, &d.domainOptions)
+		require.NoError(t, err)
+		require.Equal(t, []string{"transfer."}, d.TransferKeys)
+		require.Equal(t, []string{"192.0.2.0/24", "key", "transfer."}, d.spec().Transfer)
+		require.NoError(t, cfg.checkTransferKeys())
+
+		msgs = transfer(tcp("192.0.2.53"), "example1.com.", dns.TypeAXFR)
+		require.Equal(t, dns.RcodeRefused, msgs[0].Rcode, "request is not signed")
+
+		r := new(dns.Msg)
+		r.SetAxfr("example1.com.")
+		r.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+		w := &tsigResponseWriter{dummyResponseWriter: tcp("192.0.2.53")}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, dns.RcodeRefused, w.GetMsgs()[0].Rcode, "key is not a transfer key")
+
+		r = new(dns.Msg)
+		r.SetAxfr("example1.com.")
+		r.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+		w = &tsigResponseWriter{dummyResponseWriter: tcp("192.0.2.53"), status: dns.ErrSig}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, dns.RcodeRefused, w.GetMsgs()[0].Rcode, "signature is invalid")
+
+		w = &tsigResponseWriter{dummyResponseWriter: tcp("192.0.2.53")}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, 8, len(w.GetMsgs()[0].Answer))
+		require.NotNil(t, w.GetMsgs()[0].IsTsig())
+
+		// the replies without the zone are signed as well
+		r = new(dns.Msg)
+		r.SetIxfr("example1.com.", cfg.Serial, "", "")
+		r.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+		w = &tsigResponseWriter{dummyResponseWriter: tcp("192.0.2.53")}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, 1, len(w.GetMsgs()[0].Answer), "up to date")
+		require.NotNil(t, w.GetMsgs()[0].IsTsig(), "up to date")
+
+		udp := func() *dummyResponseWriter {
+			return &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}}
+		}
+		w = &tsigResponseWriter{dummyResponseWriter: udp()}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, 1, len(w.GetMsgs()[0].Answer), "IXFR over UDP")
+		require.NotNil(t, w.GetMsgs()[0].IsTsig(), "IXFR over UDP")
+
+		r = new(dns.Msg)
+		r.SetAxfr("example1.com.")
+		r.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+		w = &tsigResponseWriter{dummyResponseWriter: udp()}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, dns.RcodeRefused, w.GetMsgs()[0].Rcode, "AXFR over UDP")
+		require.NotNil(t, w.GetMsgs()[0].IsTsig(), "AXFR over UDP")
+
+		w = &tsigResponseWriter{dummyResponseWriter: tcp("198.51.100.1")}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, dns.RcodeRefused, w.GetMsgs()[0].Rcode, "client is not allowed")
+		require.NotNil(t, w.GetMsgs()[0].IsTsig(), "client is not allowed")
+	})
+
+	t.Run("Signed", func(t *testing.T) {
+		d := cfg.Domains[0]
+		kskFile, _ := writeKey(t, "example1.com.", dns.ZONE|dns.SEP)
+		d.KeyFiles = []string{kskFile}
+		require.NoError(t, d.loadKeys())
+		defer func() { d.KeyFiles, d.Keys = nil, nil }()
+
+		for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+			msgs := transfer(tcp("192.0.2.53"), "example1.com.", qtype)
+			require.Equal(t, 1, len(msgs))
+			require.Equal(t, dns.RcodeRefused, msgs[0].Rcode)
+			require.Empty(t, msgs[0].Answer)
+		}
+	})
+
+	t.Run("Apex", func(t *testing.T) {
+		w := tcp("198.51.100.1")
+		r := new(dns.Msg)
+		r.SetQuestion("example2.com.", dns.TypeNS)
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, "ns1.example2.com.", w.GetMsgs()[0].Answer[0].(*dns.NS).Ns)
+
+		r.SetQuestion("example2.com.", dns.TypeSOA)
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, cfg.Serial, w.GetMsgs()[1].Answer[0].(*dns.SOA).Serial)
+	})
+
+	t.Run("Invalid Enumerate", func(t *testing.T) {
+		_, err := parseEnumerateOption([]string{"10.0.0.0/16"}, &domainOptions{})
+		require.Error(t, err)
+		_, err = parseEnumerateOption([]string{"2001:db8::/64"}, &domainOptions{})
+		require.Error(t, err)
+		require.Error(t, parseTSIGPart([]string{"transfer."}, &config{}))
+		_, err = parseTransferOption([]string{"192.0.2.0/24", "key"}, &domainOptions{})
+		require.Error(t, err)
+		_, err = newConfigFromDispenser(caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+			{
+				domain example.com {
+					transfer 192.0.2.0/24 key unknown.
+				}
+			}
+		`))))
+		require.EqualError(t, err, "transfer uses the unknown tsig key 'unknown.'")
+	})
+}
+
+func TestNextSerial(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	require.GreaterOrEqual(t, nextSerial(1), now)
+	require.Equal(t, now+1001, nextSerial(now+1000))
+
+	store := newConfigStore(&config{Serial: 1})
+	require.NoError(t, store.Update(func(cfg *config) error { return nil }))
+	require.GreaterOrEqual(t, store.Load().Serial, now)
+	serial := store.Load().Serial
+	require.Error(t, store.Update(func(cfg *config) error { return errors.New("failed") }))
+	require.Equal(t, serial, store.Load().Serial)
+}
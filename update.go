@@ -0,0 +1,404 @@
+package ipecho
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// dynamicRecords are the records added with dynamic updates (RFC 2136), keyed by domain.
+// They are kept in memory and written to a JSON file after every update, so they survive restarts and
+// reloads of the config.
+type dynamicRecords struct {
+	path string
+	// records holds a map[string]staticRecords, it is replaced instead of being modified
+	records atomic.Value
+	// mu serializes updates
+	mu sync.Mutex
+}
+
+// newDynamicRecords reads the records of path, a missing file has no records.
+func newDynamicRecords(path string) (*dynamicRecords, error) {
+	d := &dynamicRecords{path: path}
+	records := map[string]staticRecords{}
+	d.records.Store(records)
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read dynamic records: %w", err)
+	}
+	var lines map[string][]string
+	if err := json.Unmarshal(b, &lines); err != nil {
+		return nil, fmt.Errorf("unable to read dynamic records %s: %w", path, err)
+	}
+	for domain, rrs := range lines {
+		domain = dns.CanonicalName(domain)
+		records[domain] = staticRecords{}
+		for _, line := range rrs {
+			rr, err := dns.NewRR(line)
+			if err != nil || rr == nil {
+				return nil, fmt.Errorf("%s: invalid record '%s'", path, line)
+			}
+			if err := records[domain].add(domain, rr); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return d, nil
+}
+
+// domain returns the records of the domain, they must not be modified. It is safe to call on a nil d.
+func (d *dynamicRecords) domain(name string) staticRecords {
+	if d == nil {
+		return nil
+	}
+	return d.records.Load().(map[string]staticRecords)[name]
+}
+
+// update applies fn to a copy of the records of domain, saves them and publishes them if fn succeeds.
+// fn must not modify the slices of the records, it replaces them.
+func (d *dynamicRecords) update(domain string, fn func(records staticRecords) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := d.records.Load().(map[string]staticRecords)
+	records := make(staticRecords, len(current[domain]))
+	for name, rrs := range current[domain] {
+		records[name] = rrs
+	}
+	if err := fn(records); err != nil {
+		return err
+	}
+	next := make(map[string]staticRecords, len(current)+1)
+	for name, r := range current {
+		next[name] = r
+	}
+	next[domain] = records
+	if err := d.save(next); err != nil {
+		return err
+	}
+	d.records.Store(next)
+	return nil
+}
+
+// save writes all records, it replaces the previous file atomically.
+func (d *dynamicRecords) save(records map[string]staticRecords) error {
+	lines := make(map[string][]string, len(records))
+	for domain, r := range records {
+		if len(r) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(r))
+		for name := range r {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, rr := range r[name] {
+				lines[domain] = append(lines[domain], rr.String())
+			}
+		}
+	}
+	b, err := json.MarshalIndent(lines, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// rcodeError fails an update with the rcode.
+type rcodeError int
+
+func (e rcodeError) Error() string { return dns.RcodeToString[int(e)] }
+
+// parseDynamicPart parses the file the records of dynamic updates are kept in.
+func parseDynamicPart(args []string, cfg *config) error {
+	if len(args) != 1 {
+		return fmt.Errorf("dynamic takes the path of the file the updated records are kept in")
+	}
+	cfg.Dynamic = args[0]
+	return nil
+}
+
+func parseUpdateOption(args []string, opts *domainOptions) (option, error) {
+	opts.Update = make([]string, 0, len(args))
+	for _, arg := range args {
+		opts.Update = append(opts.Update, dns.CanonicalName(arg))
+	}
+	return optionUpdate, nil
+}
+
+// checkUpdates reports an error if updates are allowed without a file to keep the records in or with a TSIG key
+// that is not configured.
+func (cfg *config) checkUpdates() error {
+	keys := cfg.Update
+	for _, d := range cfg.Domains {
+		keys = append(keys, cfg.effectiveOptions(d).Update...)
+	}
+	if len(keys) > 0 && cfg.Dynamic == "" {
+		return fmt.Errorf("update needs a file for the updated records, see dynamic")
+	}
+	for _, key := range keys {
+		if _, ok := cfg.TSIG[key]; !ok {
+			return fmt.Errorf("update uses the unknown tsig key '%s'", key)
+		}
+	}
+	return nil
+}
+
+// updateAllowed reports whether the request is signed with one of the TSIG keys that may update the domain.
+func (p *ipecho) updateAllowed(w dns.ResponseWriter, r *dns.Msg, opts *domainOptions) bool {
+	t := r.IsTsig()
+	if p.Dynamic == nil || t == nil || w.TsigStatus() != nil {
+		return false
+	}
+	for _, key := range opts.Update {
+		if strings.EqualFold(key, t.Hdr.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies a dynamic update (RFC 2136) to one of the domains. Names with static records cannot be updated,
+// the SOA and the NS records of the domain are left alone. It reports false if the update is not for a domain.
+func (p *ipecho) update(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, bool) {
+	question := r.Question[0]
+	domain := p.Config.findDomain(strings.ToLower(question.Name))
+	if domain == nil {
+		return dns.RcodeSuccess, false
+	}
+	opts := p.Config.effectiveOptions(domain)
+
+	rcode := dns.RcodeSuccess
+	switch {
+	case len(r.Question) != 1 || question.Qtype != dns.TypeSOA:
+		rcode = dns.RcodeFormatError
+	case !p.updateAllowed(w, r, &opts):
+		rcode = dns.RcodeRefused
+	default:
+		err := p.Dynamic.update(domain.Name, func(records staticRecords) error {
+			if rcode := checkPrerequisites(domain, records, r.Answer); rcode != dns.RcodeSuccess {
+				return rcodeError(rcode)
+			}
+			if rcode := checkUpdateSection(domain, r.Ns); rcode != dns.RcodeSuccess {
+				return rcodeError(rcode)
+			}
+			for _, rr := range r.Ns {
+				applyUpdate(domain.Name, records, rr)
+			}
+			return nil
+		})
+		var e rcodeError
+		if errors.As(err, &e) {
+			rcode = int(e)
+		} else if err != nil {
+			log.Printf("[ipecho] Warning: unable to save the update of '%s': %s\n", domain.Name, err)
+			rcode = dns.RcodeServerFailure
+		} else if p.Store != nil {
+			// bump the serial, so secondaries transfer the domain again
+			_ = p.Store.Update(func(*config) error { return nil })
+		}
+	}
+	if p.Config.Debug {
+		log.Printf("[ipecho] Answering update of '%s' from '%s' with %s\n", domain.Name, clientIP(w), dns.RcodeToString[rcode])
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+	}
+	p.writeMsg(ctx, w, r, m, domain.Name, time.Now())
+	return rcode, true
+}
+
+// current returns the records of name, the static records take precedence over the updated ones.
+func current(domain *domainConfig, records staticRecords, name string) []dns.RR {
+	if rrs, ok := domain.Records[name]; ok {
+		return rrs
+	}
+	return records[name]
+}
+
+// checkPrerequisites checks the prerequisite section of an update (RFC 2136 3.2) and returns the rcode.
+func checkPrerequisites(domain *domainConfig, records staticRecords, prereqs []dns.RR) int {
+	// the value dependent prerequisites by name and type
+	rrsets := map[string][]dns.RR{}
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(domain.Name, name) {
+			return dns.RcodeNotZone
+		}
+		rrs := current(domain, records, name)
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY && len(rrs) == 0 {
+				return dns.RcodeNameError
+			}
+			if hdr.Rrtype != dns.TypeANY && !hasType(rrs, hdr.Rrtype) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY && len(rrs) > 0 {
+				return dns.RcodeYXDomain
+			}
+			if hdr.Rrtype != dns.TypeANY && hasType(rrs, hdr.Rrtype) {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			key := name + " " + dns.TypeToString[hdr.Rrtype]
+			rrsets[key] = append(rrsets[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		var existing []dns.RR
+		for _, rr := range current(domain, records, strings.ToLower(hdr.Name)) {
+			if rr.Header().Rrtype == hdr.Rrtype {
+				existing = append(existing, rr)
+			}
+		}
+		if !sameRRset(rrset, existing) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// sameRRset reports whether a and b hold the same records, ignoring the owner case and the TTL.
+func sameRRset(a, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, r := range rrs {
+			if isDuplicate(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDuplicate(a, b dns.RR) bool {
+	a, b = dns.Copy(a), dns.Copy(b)
+	a.Header().Name, b.Header().Name = strings.ToLower(a.Header().Name), strings.ToLower(b.Header().Name)
+	a.Header().Class, b.Header().Class = dns.ClassINET, dns.ClassINET
+	return dns.IsDuplicate(a, b)
+}
+
+// checkUpdateSection checks the update section (RFC 2136 3.4.1) and returns the rcode.
+func checkUpdateSection(domain *domainConfig, updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(domain.Name, name) {
+			return dns.RcodeNotZone
+		}
+		if _, ok := domain.Records[name]; ok {
+			return dns.RcodeRefused
+		}
+		switch hdr.Rrtype {
+		case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+			return dns.RcodeFormatError
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate applies a single record of the update section to records.
+func applyUpdate(domain string, records staticRecords, rr dns.RR) {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	rrs := records[name]
+	keep := func(drop func(dns.RR) bool) {
+		var kept []dns.RR
+		for _, r := range rrs {
+			if !drop(r) {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(records, name)
+		} else {
+			records[name] = kept
+		}
+	}
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		if hdr.Rrtype == dns.TypeSOA || (hdr.Rrtype == dns.TypeNS && name == domain) {
+			// the SOA and the NS records of the domain are synthesized
+			return
+		}
+		if hdr.Rrtype == dns.TypeCNAME && len(rrs) > 0 && !hasType(rrs, dns.TypeCNAME) ||
+			hdr.Rrtype != dns.TypeCNAME && hasType(rrs, dns.TypeCNAME) {
+			// a CNAME cannot coexist with other records
+			return
+		}
+		add := dns.Copy(rr)
+		add.Header().Name = name
+		keep(func(r dns.RR) bool {
+			return isDuplicate(r, add) || (hdr.Rrtype == dns.TypeCNAME && r.Header().Rrtype == dns.TypeCNAME)
+		})
+		records[name] = append(records[name][:len(records[name]):len(records[name])], add)
+	case dns.ClassANY:
+		keep(func(r dns.RR) bool { return hdr.Rrtype == dns.TypeANY || r.Header().Rrtype == hdr.Rrtype })
+	case dns.ClassNONE:
+		keep(func(r dns.RR) bool { return isDuplicate(r, rr) })
+	}
+}
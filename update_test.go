@@ -0,0 +1,196 @@
+package ipecho
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+func TestUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dynamic.json")
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain dev.example.com {
+				record www A 192.0.2.1
+				update ci.
+				transfer 127.0.0.1
+			}
+			domain example.com
+			tsig ci. c2VjcmV0
+			tsig other. c2VjcmV0
+			dynamic `+path+`
+			ttl 60
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	dynamic, err := newDynamicRecords(cfg.Dynamic)
+	require.NoError(t, err)
+	p := ipecho{Config: cfg, Store: newConfigStore(cfg), Dynamic: dynamic}
+
+	update := func(key string, status error, fn func(m *dns.Msg)) int {
+		m := new(dns.Msg)
+		m.SetUpdate("dev.example.com.")
+		fn(m)
+		if key != "" {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := &tsigResponseWriter{dummyResponseWriter: &dummyResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}, status: status}
+		p.ServeDNS(context.Background(), w, m)
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0].Rcode
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		w := &dummyResponseWriter{}
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		p.ServeDNS(context.Background(), w, r)
+		return w.GetMsgs()[0]
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+
+	t.Run("Insert", func(t *testing.T) {
+		serial := p.Store.Load().Serial
+		require.Equal(t, dns.RcodeSuccess, update("ci.", nil, func(m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{rr("pr-123.dev.example.com. 0 IN ANY")})
+			m.Insert([]dns.RR{rr("pr-123.dev.example.com. 30 IN A 10.1.2.3"), rr("PR-123.dev.example.com. 30 IN TXT ci")})
+		}))
+		require.NotEqual(t, serial, p.Store.Load().Serial)
+
+		m := query("pr-123.dev.example.com.", dns.TypeA)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "10.1.2.3", m.Answer[0].(*dns.A).A.String())
+		require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+
+		m = query("10.0.0.1.dev.example.com.", dns.TypeA)
+		require.Equal(t, "10.0.0.1", m.Answer[0].(*dns.A).A.String(), "other names still embed an address")
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(b), `"pr-123.dev.example.com.\t30\tIN\tA\t10.1.2.3"`)
+
+		reloaded, err := newDynamicRecords(path)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(reloaded.domain("dev.example.com.")["pr-123.dev.example.com."]))
+	})
+
+	t.Run("Prerequisites", func(t *testing.T) {
+		require.Equal(t, dns.RcodeYXDomain, update("ci.", nil, func(m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{rr("pr-123.dev.example.com. 0 IN ANY")})
+		}))
+		require.Equal(t, dns.RcodeNXRrset, update("ci.", nil, func(m *dns.Msg) {
+			m.RRsetUsed([]dns.RR{rr("pr-123.dev.example.com. 0 IN AAAA ::1")})
+		}))
+		require.Equal(t, dns.RcodeNXRrset, update("ci.", nil, func(m *dns.Msg) {
+			m.Used([]dns.RR{rr("pr-123.dev.example.com. 0 IN A 10.9.9.9")})
+		}))
+		require.Equal(t, dns.RcodeSuccess, update("ci.", nil, func(m *dns.Msg) {
+			m.Used([]dns.RR{rr("pr-123.dev.example.com. 0 IN A 10.1.2.3")})
+			m.Insert([]dns.RR{rr("pr-123.dev.example.com. 30 IN A 10.1.2.4")})
+		}))
+		require.Equal(t, 2, len(query("pr-123.dev.example.com.", dns.TypeA).Answer))
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		require.Equal(t, dns.RcodeSuccess, update("ci.", nil, func(m *dns.Msg) {
+			m.Remove([]dns.RR{rr("pr-123.dev.example.com. 0 IN A 10.1.2.3")})
+		}))
+		require.Equal(t, 1, len(query("pr-123.dev.example.com.", dns.TypeA).Answer))
+
+		require.Equal(t, dns.RcodeSuccess, update("ci.", nil, func(m *dns.Msg) {
+			m.RemoveRRset([]dns.RR{rr("pr-123.dev.example.com. 0 IN A 0.0.0.0")})
+		}))
+		m := query("pr-123.dev.example.com.", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode, "the TXT record is left")
+		require.Equal(t, 0, len(m.Answer))
+
+		require.Equal(t, dns.RcodeSuccess, update("ci.", nil, func(m *dns.Msg) {
+			m.RemoveName([]dns.RR{rr("pr-123.dev.example.com. 0 IN ANY")})
+		}))
+		require.Equal(t, dns.RcodeNameError, query("pr-123.dev.example.com.", dns.TypeTXT).Rcode)
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		insert := func(m *dns.Msg) { m.Insert([]dns.RR{rr("pr-1.dev.example.com. 30 IN A 10.1.2.3")}) }
+		require.Equal(t, dns.RcodeRefused, update("", nil, insert), "not signed")
+		require.Equal(t, dns.RcodeRefused, update("other.", nil, insert), "key may not update the domain")
+		require.Equal(t, dns.RcodeRefused, update("ci.", dns.ErrSig, insert), "invalid signature")
+		require.Equal(t, dns.RcodeRefused, update("ci.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr("www.dev.example.com. 30 IN A 10.1.2.3")})
+		}), "static records cannot be updated")
+		require.Equal(t, dns.RcodeNotZone, update("ci.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr("www.example.com. 30 IN A 10.1.2.3")})
+		}))
+		require.Equal(t, dns.RcodeNameError, query("pr-1.dev.example.com.", dns.TypeA).Rcode)
+	})
+
+	t.Run("Transfer", func(t *testing.T) {
+		require.Equal(t, dns.RcodeSuccess, update("ci.", nil, func(m *dns.Msg) {
+			m.Insert([]dns.RR{rr("pr-7.dev.example.com. 30 IN A 10.1.2.7")})
+		}))
+		r := new(dns.Msg)
+		r.SetAxfr("dev.example.com.")
+		r.SetTsig("ci.", dns.HmacSHA256, 300, time.Now().Unix())
+		w := &tsigResponseWriter{dummyResponseWriter: &dummyResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}}
+		p.ServeDNS(context.Background(), w, r)
+		var names []string
+		for _, rr := range w.GetMsgs()[0].Answer {
+			names = append(names, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+		}
+		require.Equal(t, []string{
+			"dev.example.com. SOA",
+			"dev.example.com. NS",
+			"pr-7.dev.example.com. A",
+			"www.dev.example.com. A",
+			"dev.example.com. SOA",
+		}, names)
+	})
+
+	t.Run("Admin API Keys", func(t *testing.T) {
+		api := newAdminAPI("secret", p.Store)
+		put := func(body string) int {
+			req := httptest.NewRequest(http.MethodPut, "/domains/example.com", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		require.Equal(t, http.StatusOK, put(`{"update": ["other."]}`))
+		require.Equal(t, []string{"other."}, p.Store.Load().findDomain("example.com.").Update)
+		require.Equal(t, http.StatusBadRequest, put(`{"update": ["unknown."]}`))
+		require.Equal(t, []string{"other."}, p.Store.Load().findDomain("example.com.").Update)
+	})
+}
+
+func TestUpdateConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"No File", "domain example.com {\n update ci.\n }\n tsig ci. c2VjcmV0", "see dynamic"},
+		{"Unknown Key", "domain example.com\n update ci.\n dynamic /tmp/dynamic.json", "unknown tsig key 'ci.'"},
+		{"No Path", "domain example.com\n dynamic", "dynamic takes the path"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader("{\n"+tt.config+"\n}")))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
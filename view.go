@@ -0,0 +1,275 @@
+package ipecho
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// view overrides the options and records of the domains for the clients in its networks.
+type view struct {
+	// Name of the view, used in the logs
+	Name string
+	// Clients are the networks of the clients that see this view
+	Clients []*net.IPNet
+	// ECS trusts the client subnet of the EDNS0 client subnet option, if the query carries one
+	ECS bool
+	// domainOptions override the options of every domain for the clients of this view
+	domainOptions
+	// set holds the options that were given for this view
+	set option
+	// Domains override the options, records and templates of single domains, keyed by the domain name
+	Domains map[string]*domainConfig
+}
+
+// network returns the network of the clients of v that addr belongs to, nil if it belongs to none.
+func (v *view) network(addr net.IP) *net.IPNet {
+	if addr == nil {
+		return nil
+	}
+	for _, n := range v.Clients {
+		if n.Contains(addr) {
+			return n
+		}
+	}
+	return nil
+}
+
+// selectView returns the first view the query r belongs to, nil if it belongs to none. If a view trusted the client
+// subnet option of r, the option to echo in the response is returned as well (RFC 7871).
+func (cfg *config) selectView(w dns.ResponseWriter, r *dns.Msg) (*view, *dns.EDNS0_SUBNET) {
+	if len(cfg.Views) == 0 {
+		return nil, nil
+	}
+	client := net.ParseIP(clientIP(w))
+	subnet := ecsOption(r)
+	// scope is the prefix length of the client subnet the selection depends on, -1 if it does not depend on it
+	scope := -1
+	for _, v := range cfg.Views {
+		addr := client
+		trusted := v.ECS && subnet != nil
+		if trusted {
+			addr = subnet.Address
+		}
+		n := v.network(addr)
+		if s := v.scope(addr, n); trusted && s > scope {
+			scope = s
+		}
+		if n != nil {
+			if cfg.Debug {
+				log.Printf("[ipecho] Query from '%s' uses view '%s'\n", clientIP(w), v.Name)
+			}
+			return v, echoSubnet(subnet, scope)
+		}
+	}
+	return nil, echoSubnet(subnet, scope)
+}
+
+// scope returns the prefix length of addr that tells whether it belongs to n, the network of v it belongs to, or
+// if n is nil, to none of the networks of v.
+func (v *view) scope(addr net.IP, n *net.IPNet) int {
+	if n != nil {
+		ones, _ := n.Mask.Size()
+		return ones
+	}
+	scope := 0
+	for _, c := range v.Clients {
+		ones, _ := c.Mask.Size()
+		if bit := differingBit(addr, c.IP, ones); bit > scope {
+			scope = bit
+		}
+	}
+	return scope
+}
+
+// differingBit returns the position, counted from 1, of the first bit of the leading bits of a and b that differs.
+// Addresses of different families differ in no bit.
+func differingBit(a, b net.IP, bits int) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		a, b = a4, b4
+	}
+	if a == nil || b == nil {
+		return 0
+	}
+	for i := 0; i < bits; i++ {
+		mask := byte(0x80) >> (i % 8)
+		if a[i/8]&mask != b[i/8]&mask {
+			return i + 1
+		}
+	}
+	return bits
+}
+
+// ecsOption returns the EDNS0 client subnet option of r, nil if there is none.
+func ecsOption(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// echoSubnet returns the client subnet option of the response to a query with the option subnet, nil if the answer
+// does not depend on it (scope is -1).
+func echoSubnet(subnet *dns.EDNS0_SUBNET, scope int) *dns.EDNS0_SUBNET {
+	if subnet == nil || scope < 0 {
+		return nil
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		SourceScope:   uint8(scope),
+		Address:       subnet.Address,
+	}
+}
+
+// addSubnet adds the client subnet option subnet, if any, to the response m to r.
+func addSubnet(r, m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	if subnet == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(r.IsEdns0().UDPSize(), r.IsEdns0().Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, subnet)
+}
+
+// domain returns the domain block of v for d, nil if v is nil or has none.
+func (v *view) domain(d *domainConfig) *domainConfig {
+	if v == nil {
+		return nil
+	}
+	return v.Domains[d.Name]
+}
+
+// viewOptions returns the options of d for the clients of v. The options of v override the effective options
+// of d, the domain block of v for d overrides both.
+func (cfg *config) viewOptions(d *domainConfig, v *view) domainOptions {
+	opts := cfg.effectiveOptions(d)
+	if v == nil {
+		return opts
+	}
+	opts.override(&v.domainOptions, v.set)
+	if vd := v.domain(d); vd != nil {
+		opts.override(&vd.domainOptions, vd.set)
+	}
+	return opts
+}
+
+// parseViewPart parses a view block.
+func parseViewPart(c *caddyfile.Dispenser, cfg *config) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	v := &view{Name: c.Val(), Domains: map[string]*domainConfig{}}
+	for _, other := range cfg.Views {
+		if strings.EqualFold(other.Name, v.Name) {
+			return c.Errf("view '%s' is given twice", v.Name)
+		}
+	}
+	if !c.NextArg() || c.Val() != "{" {
+		return c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			break
+		}
+		if err := parseViewOptionPart(c, v); err != nil {
+			return err
+		}
+	}
+	if len(v.Clients) == 0 {
+		return c.Errf("view '%s' has no clients", v.Name)
+	}
+	cfg.Views = append(cfg.Views, v)
+	return nil
+}
+
+// parseViewOptionPart parses a line of a view block.
+func parseViewOptionPart(c *caddyfile.Dispenser, v *view) error {
+	switch {
+	case strings.EqualFold(c.Val(), "clients"):
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		clients, err := parseNetworks(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		v.Clients = append(v.Clients, clients...)
+	case strings.EqualFold(c.Val(), "ecs"):
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		v.ECS = true
+	case strings.EqualFold(c.Val(), "domain"):
+		d, err := parseDomainBlock(c)
+		if err != nil {
+			return err
+		}
+		if name := zoneOptionName(d.set); name != "" {
+			return c.Errf("%s cannot be given for domain '%s' in view '%s', it applies to every client", name, d.Name, v.Name)
+		}
+		if len(d.KeyFiles) > 0 || d.Rollover != nil {
+			return c.Errf("dnssec cannot be given for domain '%s' in view '%s', it applies to every client", d.Name, v.Name)
+		}
+		if _, ok := v.Domains[d.Name]; ok {
+			return c.Errf("domain '%s' is given twice in view '%s'", d.Name, v.Name)
+		}
+		v.Domains[d.Name] = d
+	default:
+		if _, ok := optionParsers[strings.ToLower(c.Val())]; !ok {
+			return c.Errf("unknown property '%s' for view '%s'", c.Val(), v.Name)
+		}
+		set, err := parseOptionPart(c, &v.domainOptions)
+		if err != nil {
+			return err
+		}
+		if name := zoneOptionName(set); name != "" {
+			return c.Errf("%s cannot be given in view '%s', it applies to every client", name, v.Name)
+		}
+		v.set |= set
+	}
+	return nil
+}
+
+// zoneOptions are the names of the options that apply to a domain for every client, transfers and updates are
+// not answered per view.
+//
+//nolint: gochecknoglobals // lookup table
+var zoneOptions = []struct {
+	name string
+	set  option
+}{{"transfer", optionTransfer}, {"enumerate", optionEnumerate}, {"update", optionUpdate}}
+
+// zoneOptionName returns the name of a zone option in set, empty if there is none.
+func zoneOptionName(set option) string {
+	for _, o := range zoneOptions {
+		if set&o.set != 0 {
+			return o.name
+		}
+	}
+	return ""
+}
+
+// viewNames returns the names of the views for the logs.
+func (cfg *config) viewNames() string {
+	names := make([]string, 0, len(cfg.Views))
+	for _, v := range cfg.Views {
+		names = append(names, fmt.Sprintf("%s (%s)", v.Name, strings.Join(networkStrings(v.Clients), " ")))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,162 @@
+package ipecho
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+func TestTranslate(t *testing.T) {
+	m, err := parseNATMapping("10.0.0.0/8", "100.64.0.0/8")
+	require.NoError(t, err)
+	m6, err := parseNATMapping("fd00::/64", "2001:db8::/64")
+	require.NoError(t, err)
+	mappings := []natMapping{m, m6}
+
+	require.Equal(t, net.ParseIP("100.1.2.3").To4(), translate(mappings, net.ParseIP("10.1.2.3")))
+	require.Equal(t, net.ParseIP("2001:db8::1"), translate(mappings, net.ParseIP("fd00::1")))
+	require.Equal(t, net.ParseIP("192.0.2.1"), translate(mappings, net.ParseIP("192.0.2.1")))
+
+	_, err = parseNATMapping("10.0.0.0/8", "100.64.0.0/10")
+	require.Error(t, err)
+	_, err = parseNATMapping("10.0.0.0/8", "fd00::/8")
+	require.Error(t, err)
+}
+
+func TestServeDNSViews(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte(`
+		{
+			domain example1.com {
+				record www A 192.0.2.1
+			}
+			domain example2.com
+			view inside {
+				clients 10.0.0.0/8
+				ttl 30
+			}
+			view outside {
+				clients 0.0.0.0/0 ::/0
+				ecs
+				domain example1.com {
+					nat 10.0.0.0/24 203.0.113.0/24
+					deny 192.168.0.0/16
+					record www A 198.51.100.1
+				}
+				deny 10.1.0.0/16
+			}
+			ttl 60
+		}
+	`)))
+	cfg, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(cfg.Views))
+	p := ipecho{Config: cfg}
+
+	query := func(client, name string, ecs net.IP) *dns.Msg {
+		w := &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP(client), Port: 53}}
+		r := &dns.Msg{Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: dns.TypeA}}}
+		if ecs != nil {
+			r.SetEdns0(dns.DefaultMsgSize, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: ecs,
+			})
+		}
+		p.ServeDNS(context.Background(), w, r)
+		require.Equal(t, 1, len(w.GetMsgs()))
+		return w.GetMsgs()[0]
+	}
+
+	t.Run("Inside", func(t *testing.T) {
+		m := query("10.0.0.1", "10.0.0.5.example1.com.", nil)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+		require.Equal(t, net.ParseIP("10.0.0.5").To4(), m.Answer[0].(*dns.A).A.To4())
+
+		m = query("10.0.0.1", "www.example1.com.", nil)
+		require.Equal(t, net.ParseIP("192.0.2.1").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("Outside", func(t *testing.T) {
+		m := query("192.0.2.1", "10.0.0.5.example1.com.", nil)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+		require.Equal(t, net.ParseIP("203.0.113.5").To4(), m.Answer[0].(*dns.A).A.To4())
+
+		m = query("192.0.2.1", "192.168.0.1.example1.com.", nil)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+		require.Equal(t, uint32(60), m.Ns[0].Header().Ttl)
+
+		m = query("192.0.2.1", "www.example1.com.", nil)
+		require.Equal(t, net.ParseIP("198.51.100.1").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("View Options Apply To Every Domain", func(t *testing.T) {
+		m := query("192.0.2.1", "10.1.0.1.example2.com.", nil)
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+
+		m = query("192.0.2.1", "10.2.0.1.example2.com.", nil)
+		require.Equal(t, net.ParseIP("10.2.0.1").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("ECS Is Only Trusted By Views With ecs", func(t *testing.T) {
+		// the inside view does not trust ECS, the outside view uses the client subnet
+		m := query("10.0.0.1", "10.0.0.5.example1.com.", net.ParseIP("192.0.2.0"))
+		require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+		require.Nil(t, ecsOption(m), "the view does not depend on the client subnet")
+
+		p.Config.Views[0].ECS = true
+		defer func() { p.Config.Views[0].ECS = false }()
+		m = query("10.0.0.1", "10.0.0.5.example1.com.", net.ParseIP("192.0.2.0"))
+		require.Equal(t, net.ParseIP("203.0.113.5").To4(), m.Answer[0].(*dns.A).A.To4())
+	})
+
+	t.Run("ECS Is Echoed With The Scope Of The View", func(t *testing.T) {
+		m := query("192.0.2.1", "10.0.0.5.example1.com.", net.ParseIP("198.51.100.0"))
+		subnet := ecsOption(m)
+		require.NotNil(t, subnet)
+		require.Equal(t, uint16(1), subnet.Family)
+		require.Equal(t, uint8(24), subnet.SourceNetmask)
+		require.Equal(t, uint8(0), subnet.SourceScope, "0.0.0.0/0 covers every client")
+		require.Equal(t, net.ParseIP("198.51.100.0").To4(), subnet.Address.To4())
+
+		m = query("192.0.2.1", "192.168.0.1.example1.com.", net.ParseIP("198.51.100.0"))
+		require.Equal(t, dns.RcodeNameError, m.Rcode)
+		require.NotNil(t, ecsOption(m), "negative answers carry the option as well")
+
+		p.Config.Views[0].ECS = true
+		defer func() { p.Config.Views[0].ECS = false }()
+		m = query("192.0.2.1", "10.0.0.5.example1.com.", net.ParseIP("10.1.2.0"))
+		require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+		require.Equal(t, uint8(8), ecsOption(m).SourceScope, "10.0.0.0/8")
+
+		// 198.51.100.0/1 tells the client apart from 10.0.0.0/8
+		m = query("10.0.0.1", "10.0.0.5.example1.com.", net.ParseIP("198.51.100.0"))
+		require.Equal(t, uint8(1), ecsOption(m).SourceScope)
+	})
+
+	t.Run("Invalid Views", func(t *testing.T) {
+		key, _ := writeKey(t, "example1.com.", dns.ZONE|dns.SEP)
+		for _, block := range []string{
+			"view inside {\n ttl 30\n }",
+			"view inside {\n clients 10.0.0.0/33\n }",
+			"view inside {\n clients 10.0.0.0/8\n unknown\n }",
+			"view inside {\n clients 10.0.0.0/8\n }\n view Inside {\n clients 10.0.0.0/8\n }",
+			"view inside {\n clients 10.0.0.0/8\n ecs on\n }",
+			"view inside",
+			"view inside {\n clients 10.0.0.0/8\n transfer 10.0.0.0/8\n }",
+			"view inside {\n clients 10.0.0.0/8\n update key.\n }",
+			"view inside {\n clients 10.0.0.0/8\n domain example1.com {\n enumerate 10.0.0.0/24\n }\n }",
+			"view inside {\n clients 10.0.0.0/8\n domain example1.com {\n dnssec " + key + "\n }\n }",
+		} {
+			dispenser := caddyfile.NewDispenser("", buffer.NewReader([]byte("{\ndomain example1.com\n"+block+"\n}")))
+			cfg, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, block)
+			require.Nil(t, cfg)
+		}
+	})
+}
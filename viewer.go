@@ -0,0 +1,153 @@
+package ipecho
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const viewPluginName = "ipecho-view"
+
+// ipechoView selects the server block it is in for queries whose embedded address is in one of its
+// networks or families. It implements the dnsserver.Viewer interface.
+type ipechoView struct {
+	Next plugin.Handler
+	// Networks the embedded address has to be in, any network matches if empty
+	Networks []*net.IPNet
+	// Families the embedded address has to be of, any family matches if zero
+	Families family
+	// name of the view for the metrics and logs of coredns
+	name string
+	// lookup returns the ipecho plugin of the server block, it decodes the address
+	lookup func() plugin.Handler
+}
+
+// ServeDNS implements the plugin.Handler interface, the view only filters.
+func (v *ipechoView) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	return plugin.NextOrFailure(v.Name(), v.Next, ctx, w, r)
+}
+
+// Name implements the plugin.Handler interface.
+func (v *ipechoView) Name() string { return viewPluginName }
+
+// ViewName implements the dnsserver.Viewer interface.
+func (v *ipechoView) ViewName() string { return v.name }
+
+// Filter implements the dnsserver.Viewer interface.
+func (v *ipechoView) Filter(_ context.Context, req *request.Request) bool {
+	p, ok := v.lookup().(ipecho)
+	if !ok {
+		return false
+	}
+	if p.Store != nil {
+		p.Config = p.Store.Load()
+	}
+	ip := p.Config.embeddedIP(req.Name())
+	if ip == nil {
+		return false
+	}
+	return v.matches(ip)
+}
+
+// matches reports whether ip is in the families and networks of v.
+func (v *ipechoView) matches(ip net.IP) bool {
+	if v.Families != 0 {
+		f := familyV6
+		if ip.To4() != nil {
+			f = familyV4
+		}
+		if v.Families&f == 0 {
+			return false
+		}
+	}
+	if len(v.Networks) == 0 {
+		return true
+	}
+	for _, n := range v.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedIP returns the address embedded in qname with the formats of its domain, nil if there is none.
+// Unlike a query it does not apply the policy of the domain, static records, views or alias redirects.
+func (cfg *config) embeddedIP(qname string) net.IP {
+	domain, _, subdomain := cfg.match(qname)
+	subdomain = strings.Trim(subdomain, ".")
+	if domain == nil || subdomain == "" {
+		return nil
+	}
+	opts := cfg.effectiveOptions(domain)
+	if ip := opts.decode(subdomain); ip != nil {
+		return ip
+	}
+	ip, _, _ := opts.decodePort(subdomain)
+	return ip
+}
+
+// newViewFromDispenser parses the ipecho-view directive c points to, its arguments are networks and families.
+func newViewFromDispenser(c *caddyfile.Dispenser) (*ipechoView, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	v := &ipechoView{name: viewPluginName + " " + strings.Join(args, " ")}
+	for _, arg := range args {
+		if f, err := parseFamilies([]string{arg}); err == nil {
+			v.Families |= f
+			continue
+		}
+		networks, err := parseNetworks([]string{arg})
+		if err != nil {
+			return nil, c.Errf("'%s' is neither a network nor a family", arg)
+		}
+		v.Networks = append(v.Networks, networks...)
+	}
+	for c.NextBlock() {
+		if !strings.EqualFold(c.Val(), "name") {
+			return nil, c.Errf("unknown property '%s'", c.Val())
+		}
+		name := c.RemainingArgs()
+		if len(name) != 1 {
+			return nil, c.ArgErr()
+		}
+		v.name = name[0]
+	}
+	if c.Next() {
+		return nil, c.Errf("%s can only be used once per server block", viewPluginName)
+	}
+	return v, nil
+}
+
+func setupView(c *caddy.Controller) error {
+	c.Next()
+	v, err := newViewFromDispenser(&c.Dispenser)
+	if err != nil {
+		return plugin.Error(viewPluginName, err)
+	}
+
+	cfg := dnsserver.GetConfig(c)
+	v.lookup = func() plugin.Handler { return cfg.Handler(ipecho{}.Name()) }
+	c.OnStartup(func() error {
+		if v.lookup() == nil {
+			return plugin.Error(viewPluginName, fmt.Errorf("the server block has no ipecho plugin"))
+		}
+		return nil
+	})
+
+	cfg.AddPlugin(func(next plugin.Handler) plugin.Handler {
+		v.Next = next
+		return v
+	})
+	return nil
+}
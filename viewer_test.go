@@ -0,0 +1,84 @@
+package ipecho
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/tdewolff/buffer"
+)
+
+var _ dnsserver.Viewer = (*ipechoView)(nil)
+
+func TestViewFilter(t *testing.T) {
+	p := ipecho{
+		Config: &config{
+			Domains: []*domainConfig{
+				{Name: "example1.com."},
+				{Name: "example2.com.", domainOptions: domainOptions{Formats: formatDash}, set: optionFormats},
+			},
+			domainOptions: domainOptions{TTL: 60},
+		},
+	}
+
+	parse := func(input string) *ipechoView {
+		c := caddyfile.NewDispenser("", buffer.NewReader([]byte(input)))
+		c.Next()
+		v, err := newViewFromDispenser(&c)
+		require.NoError(t, err)
+		v.lookup = func() plugin.Handler { return p }
+		return v
+	}
+	filter := func(v *ipechoView, name string) bool {
+		return v.Filter(context.Background(), &request.Request{
+			Req: &dns.Msg{Question: []dns.Question{{Name: name, Qclass: dns.ClassINET, Qtype: dns.TypeA}}},
+			W:   &dummyResponseWriter{},
+		})
+	}
+
+	t.Run("Networks", func(t *testing.T) {
+		v := parse("ipecho-view 10.0.0.0/8 192.168.0.1")
+		require.Equal(t, "ipecho-view 10.0.0.0/8 192.168.0.1", v.ViewName())
+		require.True(t, filter(v, "10.1.2.3.example1.com."))
+		require.True(t, filter(v, "app.10-1-2-3.example2.com."))
+		require.True(t, filter(v, "192.168.0.1.example1.com."))
+		require.False(t, filter(v, "192.168.0.2.example1.com."))
+		require.False(t, filter(v, "10-1-2-3.example1.com."), "dash format is not enabled for example1.com")
+		require.False(t, filter(v, "example1.com."))
+		require.False(t, filter(v, "10.1.2.3.example3.com."))
+	})
+
+	t.Run("Families", func(t *testing.T) {
+		v := parse("ipecho-view v6 {\n name v6-targets\n }")
+		require.Equal(t, "v6-targets", v.ViewName())
+		require.True(t, filter(v, "::1.example1.com."))
+		require.False(t, filter(v, "127.0.0.1.example1.com."))
+	})
+
+	t.Run("Without ipecho", func(t *testing.T) {
+		v := parse("ipecho-view v4")
+		v.lookup = func() plugin.Handler { return nil }
+		require.False(t, filter(v, "127.0.0.1.example1.com."))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, input := range []string{
+			"ipecho-view",
+			"ipecho-view 10.0.0.0/33",
+			"ipecho-view v4 {\n unknown\n }",
+			"ipecho-view v4 {\n name\n }",
+			"ipecho-view v4\nipecho-view v6",
+		} {
+			c := caddyfile.NewDispenser("", buffer.NewReader([]byte(input)))
+			c.Next()
+			v, err := newViewFromDispenser(&c)
+			require.Error(t, err, input)
+			require.Nil(t, v)
+		}
+	})
+}
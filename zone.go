@@ -0,0 +1,127 @@
+package ipecho
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxNegativeTTL caps the time negative answers are cached
+	maxNegativeTTL = 300
+	soaRefresh     = 7200
+	soaRetry       = 1800
+	soaExpire      = 1209600
+
+	defaultNameserver = "ns1"
+	defaultHostmaster = "hostmaster"
+)
+
+// soa returns the synthesized SOA record of zone, it is used in the authority section of negative answers.
+func (cfg *config) soa(zone string, opts *domainOptions) *dns.SOA {
+	ttl := opts.TTL
+	if ttl > maxNegativeTTL {
+		ttl = maxNegativeTTL
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ns:      cfg.nameserverNames(zone)[0],
+		Mbox:    zoneName(cfg.hostmaster(), zone),
+		Serial:  cfg.Serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  ttl,
+	}
+}
+
+// nameservers returns the NS records of zone, the first name server is the one of the synthesized SOA.
+func (cfg *config) nameservers(zone string, ttl uint32) []dns.RR {
+	names := cfg.nameserverNames(zone)
+	rrs := make([]dns.RR, 0, len(names))
+	for _, name := range names {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  name,
+		})
+	}
+	return rrs
+}
+
+// nameserverNames returns the names of the name servers of zone.
+func (cfg *config) nameserverNames(zone string) []string {
+	if len(cfg.Nameservers) == 0 {
+		return []string{zoneName(defaultNameserver, zone)}
+	}
+	names := make([]string, 0, len(cfg.Nameservers))
+	for _, name := range cfg.Nameservers {
+		names = append(names, zoneName(name, zone))
+	}
+	return names
+}
+
+func (cfg *config) hostmaster() string {
+	if cfg.Hostmaster == "" {
+		return defaultHostmaster
+	}
+	return cfg.Hostmaster
+}
+
+// zoneName returns name if it is fully qualified, otherwise the name of name below zone.
+func zoneName(name, zone string) string {
+	if dns.IsFqdn(name) {
+		return name
+	}
+	return childName(name, zone)
+}
+
+// childName returns the name of label below zone, zone may be the root.
+func childName(label, zone string) string {
+	return dns.Fqdn(label + "." + strings.TrimSuffix(zone, "."))
+}
+
+// parseNameserversPart parses "nameservers <name>...", names without a trailing dot are relative to the zone.
+func parseNameserversPart(args []string, cfg *config) error {
+	if len(args) == 0 {
+		return fmt.Errorf("nameservers needs at least one name")
+	}
+	for _, arg := range args {
+		if _, ok := dns.IsDomainName(arg); !ok || arg == "." {
+			return fmt.Errorf("'%s' is not a valid name server", arg)
+		}
+	}
+	cfg.Nameservers = lowerAll(args)
+	return nil
+}
+
+// parseHostmasterPart parses "hostmaster <mailbox>", the mailbox is an address like hostmaster@example.com or a
+// name, relative to the zone without a trailing dot.
+func parseHostmasterPart(args []string, cfg *config) error {
+	if len(args) != 1 {
+		return fmt.Errorf("hostmaster takes exactly one mailbox")
+	}
+	mbox := args[0]
+	if i := strings.LastIndexByte(mbox, '@'); i >= 0 {
+		// the dots of the local part are escaped (RFC 1035)
+		mbox = strings.ReplaceAll(mbox[:i], ".", "\\.") + "." + dns.Fqdn(mbox[i+1:])
+	}
+	if _, ok := dns.IsDomainName(mbox); !ok || mbox == "." || strings.HasPrefix(mbox, ".") {
+		return fmt.Errorf("'%s' is not a valid hostmaster mailbox", args[0])
+	}
+	cfg.Hostmaster = strings.ToLower(mbox)
+	return nil
+}
+
+func lowerAll(names []string) []string {
+	lower := make([]string, 0, len(names))
+	for _, name := range names {
+		lower = append(lower, strings.ToLower(name))
+	}
+	return lower
+}